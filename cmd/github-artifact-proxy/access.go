@@ -0,0 +1,138 @@
+package main
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strings"
+
+	"github.com/google/go-github/v60/github"
+	log "github.com/sirupsen/logrus"
+)
+
+// AccessControl restricts access to a target to callers that present one of
+// the configured bearer tokens or basic auth credentials.
+type AccessControl struct {
+	BearerTokens []string          `yaml:"bearer_tokens"`
+	BasicAuth    map[string]string `yaml:"basic_auth"`
+}
+
+// Auth restricts access to the whole proxy to callers that present one of the
+// configured basic auth credentials.
+type Auth struct {
+	BasicAuth map[string]string `yaml:"basic_auth"`
+}
+
+// checkAuth checks whether the request is allowed to access the proxy at all.
+// The health checks and the webhook are exempt, because they're called by
+// orchestrators and GitHub respectively, and the webhook has its own
+// authentication. If the request isn't allowed, an error response is written
+// and false is returned.
+func (s *Server) checkAuth(w http.ResponseWriter, r *http.Request) bool {
+	auth, webhook := s.getAuth()
+	if auth == nil ||
+		(s.HealthPaths.Liveness != "" && r.URL.Path == s.buildHealthURLPath(s.HealthPaths.Liveness)) ||
+		(s.HealthPaths.Readiness != "" && r.URL.Path == s.buildHealthURLPath(s.HealthPaths.Readiness)) ||
+		(webhook != nil && r.URL.Path == s.buildURLPath(webhook.Path)) {
+		return true
+	}
+
+	user, pass, ok := r.BasicAuth()
+	if ok {
+		expected, found := auth.BasicAuth[user]
+		ok = found && secureCompare(pass, expected)
+	}
+	if !ok {
+		requestLogger(r.Context()).WithFields(log.Fields{
+			"addr": r.RemoteAddr,
+			"path": r.URL.Path,
+		}).Warn("missing or invalid credentials")
+		w.Header().Set("WWW-Authenticate", `Basic realm="github-artifact-proxy", charset="UTF-8"`)
+		httpError(w, r, http.StatusUnauthorized)
+		return false
+	}
+
+	return true
+}
+
+func (s *Server) getAuth() (*Auth, *Webhook) {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	return s.Config.Auth, s.Config.Webhook
+}
+
+// authorizeTarget checks whether the request is allowed to access the given
+// target. If it isn't, an error response is written and false is returned.
+func authorizeTarget(w http.ResponseWriter, r *http.Request, logCtx *log.Entry, target *Target) bool {
+	if target.Access == nil {
+		return true
+	}
+
+	if r.Header.Get("Authorization") == "" {
+		logCtx.Warn("missing credentials for target")
+		if len(target.Access.BasicAuth) > 0 {
+			w.Header().Set("WWW-Authenticate", `Basic realm="github-artifact-proxy", charset="UTF-8"`)
+		}
+		httpError(w, r, http.StatusUnauthorized)
+		return false
+	}
+
+	if !target.Access.isAllowed(r) {
+		logCtx.Warn("invalid credentials for target")
+		httpError(w, r, http.StatusForbidden)
+		return false
+	}
+
+	return true
+}
+
+func (a *AccessControl) isAllowed(r *http.Request) bool {
+	if user, pass, ok := r.BasicAuth(); ok {
+		expected, ok := a.BasicAuth[user]
+		return ok && secureCompare(pass, expected)
+	}
+
+	if token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+		for _, expected := range a.BearerTokens {
+			if secureCompare(token, expected) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+func secureCompare(a string, b string) bool {
+	return subtle.ConstantTimeCompare([]byte(a), []byte(b)) == 1
+}
+
+// getClientToken returns the GitHub token in the Authorization header of the
+// request. Both the "Bearer" and the "token" scheme are accepted, like the
+// GitHub API does.
+func getClientToken(r *http.Request) (string, bool) {
+	scheme, token, ok := strings.Cut(r.Header.Get("Authorization"), " ")
+	if !ok || (!strings.EqualFold(scheme, "Bearer") && !strings.EqualFold(scheme, "token")) {
+		return "", false
+	}
+
+	token = strings.TrimSpace(token)
+	return token, token != ""
+}
+
+// isClientTokenRejected reports whether GitHub rejected the token that the
+// client passed along with the request. The token of the API request is
+// compared to the one of the client request, because the targets that use a
+// configured token also end up here.
+func isClientTokenRejected(r *http.Request, ghRes *github.Response) bool {
+	if ghRes == nil || ghRes.Response == nil || ghRes.StatusCode != http.StatusUnauthorized || ghRes.Request == nil {
+		return false
+	}
+
+	clientToken, ok := getClientToken(r)
+	if !ok {
+		return false
+	}
+	apiToken, ok := getClientToken(ghRes.Request)
+	return ok && secureCompare(clientToken, apiToken)
+}
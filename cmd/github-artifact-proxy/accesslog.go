@@ -0,0 +1,102 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// accessLogResponseWriter keeps track of the status code and the amount of
+// bytes of the response, for the access log.
+type accessLogResponseWriter struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+// withAccessLog wraps the given response writer so that a summary of the
+// response is logged once the returned function is called. Requests for the
+// health checks and the metrics are only logged at the debug level, as they're
+// typically polled.
+func (s *Server) withAccessLog(w http.ResponseWriter, r *http.Request) (http.ResponseWriter, func()) {
+	start := time.Now()
+	aw := &accessLogResponseWriter{ResponseWriter: w}
+	return aw, func() {
+		status := aw.status
+		if status == 0 {
+			status = http.StatusOK
+		}
+
+		logCtx := requestLogger(r.Context()).WithFields(log.Fields{
+			"addr":     r.RemoteAddr,
+			"method":   r.Method,
+			"path":     r.URL.Path,
+			"status":   status,
+			"duration": time.Since(start),
+			"bytes":    aw.bytes,
+		})
+		if _, params, _ := s.router.Lookup(r.Method, r.URL.Path); params.ByName("target") != "" {
+			logCtx = logCtx.WithField("target", params.ByName("target"))
+		}
+
+		level := log.InfoLevel
+		if s.isPolledPath(r.URL.Path) {
+			level = log.DebugLevel
+		}
+		logCtx.Log(level, "request completed")
+	}
+}
+
+// isPolledPath reports whether the given URL path is one of the health check or
+// metrics paths.
+func (s *Server) isPolledPath(path string) bool {
+	return (s.HealthPaths.Liveness != "" && path == s.buildHealthURLPath(s.HealthPaths.Liveness)) ||
+		(s.HealthPaths.Readiness != "" && path == s.buildHealthURLPath(s.HealthPaths.Readiness)) ||
+		(s.MetricsPath != "" && path == s.buildURLPath(s.MetricsPath))
+}
+
+func (w *accessLogResponseWriter) WriteHeader(status int) {
+	// Informational responses are followed by the actual response
+	if w.status == 0 && status >= 200 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *accessLogResponseWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(b)
+	w.bytes += int64(n)
+	return n, err
+}
+
+// ReadFrom keeps the underlying response writer's ability to use sendfile.
+func (w *accessLogResponseWriter) ReadFrom(r io.Reader) (int64, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+
+	var n int64
+	var err error
+	if rf, ok := w.ResponseWriter.(io.ReaderFrom); ok {
+		n, err = rf.ReadFrom(r)
+	} else {
+		n, err = io.Copy(w.ResponseWriter, r)
+	}
+	w.bytes += n
+	return n, err
+}
+
+func (w *accessLogResponseWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (w *accessLogResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
@@ -0,0 +1,326 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"mime"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/go-github/v60/github"
+	"github.com/julienschmidt/httprouter"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// runsPageSize is the default number of workflow runs per page when
+	// listing the runs of a target, like in the GitHub API.
+	runsPageSize = 30
+	// maxRunsPageSize is the maximum number of workflow runs per page that
+	// the GitHub API allows.
+	maxRunsPageSize = 100
+)
+
+type targetInfo struct {
+	ID           string        `json:"id"`
+	Type         string        `json:"type"`
+	Owner        string        `json:"owner"`
+	Repo         string        `json:"repo"`
+	Filenames    stringList    `json:"filename,omitempty"`
+	LatestFilter *LatestFilter `json:"latest_filter,omitempty"`
+	ArtifactID   *int64        `json:"artifact_id,omitempty"`
+}
+
+type artifactInfo struct {
+	ID        int64             `json:"id"`
+	Name      string            `json:"name"`
+	Size      int64             `json:"size"`
+	CreatedAt *github.Timestamp `json:"created_at,omitempty"`
+	UpdatedAt *github.Timestamp `json:"updated_at,omitempty"`
+	ExpiresAt *github.Timestamp `json:"expires_at,omitempty"`
+	Expired   bool              `json:"expired"`
+}
+
+type runInfo struct {
+	ID         int64             `json:"id"`
+	RunNumber  int               `json:"run_number"`
+	Status     string            `json:"status"`
+	Conclusion string            `json:"conclusion,omitempty"`
+	HeadBranch string            `json:"head_branch"`
+	HeadSHA    string            `json:"head_sha"`
+	CreatedAt  *github.Timestamp `json:"created_at,omitempty"`
+}
+
+type artifactFileInfo struct {
+	Path string `json:"path"`
+	Size int64  `json:"size"`
+}
+
+func (s *Server) handleTargetsRequest(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	logCtx := requestLogger(r.Context()).WithFields(log.Fields{
+		"addr": r.RemoteAddr,
+		"path": r.URL.Path,
+	})
+	logCtx.Info("handling targets request")
+
+	w.Header().Add("Vary", "Accept")
+	if !accepts(r, "application/json") {
+		logCtx.WithField("accept", r.Header.Get("Accept")).Warn("unsupported media type requested")
+		httpError(w, r, http.StatusNotAcceptable)
+		return
+	}
+
+	writeJSON(w, logCtx, http.StatusOK, s.getTargetInfos())
+}
+
+// handleRunsRequest lists the recent workflow runs of a target, newest first.
+// The page and per_page query parameters are passed on to the GitHub API. The
+// listings are cached like the workflow runs themselves.
+func (s *Server) handleRunsRequest(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	targetId := params.ByName("target")
+	logCtx := requestLogger(r.Context()).WithFields(log.Fields{
+		"addr":   r.RemoteAddr,
+		"path":   r.URL.Path,
+		"target": targetId,
+	})
+	logCtx.Info("handling runs request")
+
+	w.Header().Add("Vary", "Accept")
+	if !accepts(r, "application/json") {
+		logCtx.WithField("accept", r.Header.Get("Accept")).Warn("unsupported media type requested")
+		httpError(w, r, http.StatusNotAcceptable)
+		return
+	}
+
+	target, ok := s.getTarget(targetId)
+	if !ok {
+		logCtx.Warn("target not found")
+		httpError(w, r, http.StatusNotFound)
+		return
+	}
+	if !authorizeTarget(w, r, logCtx, target) {
+		return
+	}
+	writeTargetHeaders(w, target)
+
+	if target.isRelease() {
+		logCtx.Warn("release targets don't have workflow runs")
+		httpErrorDetail(w, r, http.StatusNotFound, "release targets don't have workflow runs")
+		return
+	}
+	if target.isPinned() {
+		logCtx.Warn("targets pinned to an artifact don't have workflow runs")
+		httpErrorDetail(w, r, http.StatusNotFound, "targets pinned to an artifact don't have workflow runs")
+		return
+	}
+
+	page, err := parsePageParam(r, "page", 1, 0)
+	if err != nil {
+		logCtx.WithError(err).Warn("unable to parse page")
+		httpErrorDetail(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+	perPage, err := parsePageParam(r, "per_page", runsPageSize, maxRunsPageSize)
+	if err != nil {
+		logCtx.WithError(err).Warn("unable to parse page size")
+		httpErrorDetail(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+	logCtx = logCtx.WithFields(log.Fields{
+		"page":     page,
+		"per_page": perPage,
+	})
+
+	// Clients with their own token have to prove that they can access the
+	// workflow runs, so the cache is bypassed for them
+	cacheKey := fmt.Sprintf("%d/%d", page, perPage)
+	if !target.AllowClientToken {
+		if list, ok := target.runCache.GetList(cacheKey); ok && time.Since(list.FetchTime) <= s.getCacheTTL(target) {
+			logCtx.Info("serving cached runs")
+			writeJSON(w, logCtx, http.StatusOK, list.Runs)
+			return
+		}
+	}
+
+	client, ok := s.getRequestClient(w, r, logCtx, target)
+	if !ok {
+		return
+	}
+
+	runs, ok := s.listWorkflowRuns(w, r, logCtx, targetId, target, client, &github.ListWorkflowRunsOptions{
+		ListOptions: github.ListOptions{Page: page, PerPage: perPage},
+	})
+	if !ok {
+		return
+	}
+
+	infos := make([]*runInfo, 0, len(runs))
+	for _, run := range runs {
+		infos = append(infos, &runInfo{
+			ID:         run.GetID(),
+			RunNumber:  run.GetRunNumber(),
+			Status:     run.GetStatus(),
+			Conclusion: run.GetConclusion(),
+			HeadBranch: run.GetHeadBranch(),
+			HeadSHA:    run.GetHeadSHA(),
+			CreatedAt:  run.CreatedAt,
+		})
+	}
+	if !target.AllowClientToken {
+		target.runCache.SetList(cacheKey, &RunList{Runs: infos, FetchTime: time.Now()})
+	}
+
+	writeJSON(w, logCtx, http.StatusOK, infos)
+}
+
+// parsePageParam parses the pagination query parameter with the given name. If
+// it's not set, def is returned. If max is positive, larger values are
+// rejected.
+func parsePageParam(r *http.Request, name string, def int, max int) (int, error) {
+	str := r.URL.Query().Get(name)
+	if str == "" {
+		return def, nil
+	}
+
+	value, err := strconv.Atoi(str)
+	if err != nil || value < 1 || (max > 0 && value > max) {
+		if max > 0 {
+			return 0, fmt.Errorf("invalid %s: '%s' (expected a number from 1 to %d)", name, str, max)
+		}
+		return 0, fmt.Errorf("invalid %s: '%s' (expected a positive number)", name, str)
+	}
+	return value, nil
+}
+
+// getTargetInfos returns the public information of the configured targets,
+// sorted by ID. Targets with access control are left out, so that their
+// existence isn't revealed to anyone.
+func (s *Server) getTargetInfos() []*targetInfo {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	infos := make([]*targetInfo, 0, len(s.Config.Targets))
+	for id, target := range s.Config.Targets {
+		if target.isProtected() {
+			continue
+		}
+		infos = append(infos, &targetInfo{
+			ID:           id,
+			Type:         target.getType(),
+			Owner:        target.Owner,
+			Repo:         target.Repo,
+			Filenames:    target.Filenames,
+			LatestFilter: target.LatestFilter,
+			ArtifactID:   target.ArtifactID,
+		})
+	}
+
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].ID < infos[j].ID
+	})
+	return infos
+}
+
+func newArtifactInfo(artifact *github.Artifact) *artifactInfo {
+	return &artifactInfo{
+		ID:        artifact.GetID(),
+		Name:      artifact.GetName(),
+		Size:      artifact.GetSizeInBytes(),
+		CreatedAt: artifact.CreatedAt,
+		UpdatedAt: artifact.UpdatedAt,
+		ExpiresAt: artifact.ExpiresAt,
+		Expired:   artifact.GetExpired(),
+	}
+}
+
+// serveArtifactListing writes a JSON listing of the files in the given
+// extracted artifact, unless listings are disabled.
+func (s *Server) serveArtifactListing(w http.ResponseWriter, r *http.Request, logCtx *log.Entry, fsys fs.FS) {
+	if s.DisableListings {
+		logCtx.Warn("artifact listings are disabled")
+		httpError(w, r, http.StatusNotFound)
+		return
+	}
+
+	infos, err := listArtifactFiles(fsys)
+	if err != nil {
+		logCtx.WithError(err).Error("unable to list artifact files")
+		httpError(w, r, http.StatusInternalServerError)
+		return
+	}
+
+	logCtx.Info("serving artifact listing")
+	writeJSON(w, logCtx, http.StatusOK, infos)
+}
+
+// listArtifactFiles returns the regular files in the given extracted artifact.
+func listArtifactFiles(fsys fs.FS) ([]*artifactFileInfo, error) {
+	infos := []*artifactFileInfo{}
+	err := fs.WalkDir(fsys, ".", func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+
+		infos = append(infos, &artifactFileInfo{
+			Path: path,
+			Size: info.Size(),
+		})
+		return nil
+	})
+	return infos, err
+}
+
+// requestsJSON reports whether the Accept header of the request explicitly
+// asks for a JSON response, as opposed to accepting anything.
+func requestsJSON(r *http.Request) bool {
+	for _, part := range strings.Split(r.Header.Get("Accept"), ",") {
+		accepted, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err == nil && accepted == "application/json" && params["q"] != "0" {
+			return true
+		}
+	}
+
+	return false
+}
+
+// accepts reports whether the Accept header of the request allows a response
+// of the given media type. A missing Accept header accepts everything.
+func accepts(r *http.Request, mediaType string) bool {
+	header := r.Header.Get("Accept")
+	if header == "" {
+		return true
+	}
+
+	mainType, _, _ := strings.Cut(mediaType, "/")
+	for _, part := range strings.Split(header, ",") {
+		accepted, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil || params["q"] == "0" {
+			continue
+		}
+		if accepted == mediaType || accepted == mainType+"/*" || accepted == "*/*" {
+			return true
+		}
+	}
+
+	return false
+}
+
+func writeJSON(w http.ResponseWriter, logCtx *log.Entry, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		logCtx.WithError(err).Error("unable to write json response")
+	}
+}
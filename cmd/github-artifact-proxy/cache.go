@@ -0,0 +1,495 @@
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// partialMarkerSuffix is appended to the path of an artifact directory to
+	// obtain the path of the marker file that indicates that only some files
+	// of the artifact were extracted, on their own.
+	partialMarkerSuffix = ".partial"
+	// protectedMarkerSuffix is appended to the path of an artifact directory
+	// to obtain the path of the marker file that indicates that the artifact
+	// belongs to a target with access control.
+	protectedMarkerSuffix = ".protected"
+	// tempDirInfix separates the name of an artifact directory from the random
+	// suffix of a temporary sibling directory. Artifacts are extracted to such
+	// a directory first, and then renamed into place.
+	tempDirInfix = ".tmp-"
+	// hostHashSize is the amount of bytes of the hash of a GitHub host in the
+	// key of an artifact.
+	hostHashSize = 8
+)
+
+// diskCache keeps track of the size and last access time of the extracted
+// artifacts in the download directory, so that the least recently accessed
+// ones can be evicted once the cache grows beyond its maximum size.
+type diskCache struct {
+	m       sync.Mutex
+	maxSize int64
+	size    int64
+	entries map[string]*diskCacheEntry
+}
+
+type diskCacheEntry struct {
+	dir        string
+	size       int64
+	lastAccess time.Time
+}
+
+// newDiskCache builds an index of the extracted artifacts in the given
+// directory. The modification time of an artifact directory is used as its
+// initial access time.
+func newDiskCache(dir string, maxSize int64) (*diskCache, error) {
+	c := diskCache{
+		maxSize: maxSize,
+		entries: make(map[string]*diskCacheEntry),
+	}
+
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return &c, nil
+		}
+		return nil, err
+	}
+
+	for _, file := range files {
+		key := file.Name()
+		if _, ok := parseArtifactKey(key); !ok || !file.IsDir() {
+			continue
+		}
+
+		info, err := file.Info()
+		if err != nil {
+			return nil, err
+		}
+
+		entryDir := filepath.Join(dir, file.Name())
+		size, err := getDirSize(entryDir)
+		if err != nil {
+			return nil, err
+		}
+
+		c.entries[key] = &diskCacheEntry{
+			dir:        entryDir,
+			size:       size,
+			lastAccess: info.ModTime(),
+		}
+		c.size += size
+	}
+
+	return &c, nil
+}
+
+// Add registers a freshly extracted artifact with the cache.
+func (c *diskCache) Add(key string, dir string) error {
+	size, err := getDirSize(dir)
+	if err != nil {
+		return err
+	}
+
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	if entry, ok := c.entries[key]; ok {
+		c.size -= entry.size
+	}
+	c.entries[key] = &diskCacheEntry{
+		dir:        dir,
+		size:       size,
+		lastAccess: time.Now(),
+	}
+	c.size += size
+	return nil
+}
+
+// Touch marks the given artifact as recently accessed.
+func (c *diskCache) Touch(key string) {
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	if entry, ok := c.entries[key]; ok {
+		entry.lastAccess = time.Now()
+	}
+}
+
+// Remove drops the given artifact from the cache index. It does not delete the
+// artifact directory.
+func (c *diskCache) Remove(key string) {
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	if entry, ok := c.entries[key]; ok {
+		c.size -= entry.size
+		delete(c.entries, key)
+	}
+}
+
+// Evict deletes the least recently accessed artifacts until the cache no
+// longer exceeds its maximum size. The artifact with the given key is never
+// evicted. Other artifacts are only evicted if they're neither being extracted
+// nor served, i.e. if both of their locks can be acquired without waiting. The
+// artifacts are deleted after the cache index is unlocked again, so that
+// requests that touch the index don't have to wait for that.
+func (c *diskCache) Evict(logCtx *log.Entry, locks *keyedLock[string], serveLocks *keyedRWLock[string], keepKey string) {
+	evicted := c.takeEvictable(locks, serveLocks, keepKey)
+	for key, entry := range evicted {
+		c.evictEntry(logCtx, key, entry)
+		serveLocks.Unlock(key)
+		locks.Unlock(key)
+	}
+}
+
+// takeEvictable removes the least recently accessed artifacts from the index
+// until the cache no longer exceeds its maximum size, and returns them. Both
+// locks of the returned artifacts are held, and must be released by the
+// caller once the artifacts are deleted.
+func (c *diskCache) takeEvictable(locks *keyedLock[string], serveLocks *keyedRWLock[string], keepKey string) map[string]*diskCacheEntry {
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	if c.size <= c.maxSize {
+		return nil
+	}
+
+	keys := make([]string, 0, len(c.entries))
+	for key := range c.entries {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return c.entries[keys[i]].lastAccess.Before(c.entries[keys[j]].lastAccess)
+	})
+
+	evicted := make(map[string]*diskCacheEntry)
+	for _, key := range keys {
+		if c.size <= c.maxSize {
+			break
+		}
+
+		if key == keepKey {
+			continue
+		}
+
+		if !locks.TryLock(key) {
+			continue
+		}
+		if !serveLocks.TryLock(key) {
+			locks.Unlock(key)
+			continue
+		}
+
+		entry := c.entries[key]
+		evicted[key] = entry
+		c.size -= entry.size
+		delete(c.entries, key)
+	}
+	return evicted
+}
+
+func (c *diskCache) evictEntry(logCtx *log.Entry, key string, entry *diskCacheEntry) {
+	logCtx.WithFields(log.Fields{
+		"artifact_key": key,
+		"size":         entry.size,
+		"last_access":  entry.lastAccess,
+	}).Info("evicting artifact from cache")
+
+	if err := removeArtifactDir(entry.dir); err != nil {
+		logCtx.WithError(err).WithField("dir", entry.dir).Error("unable to evict artifact from cache")
+
+		// Keep track of the artifact, so that it's evicted again later
+		c.m.Lock()
+		defer c.m.Unlock()
+		if _, ok := c.entries[key]; !ok {
+			c.entries[key] = entry
+			c.size += entry.size
+		}
+	}
+}
+
+// parseArtifactKey returns the ID of the artifact with the given key, as
+// returned by Target.getArtifactKey. Anything else is rejected.
+func parseArtifactKey(key string) (int64, bool) {
+	if host, idStr, ok := strings.Cut(key, "-"); ok {
+		if len(host) != hex.EncodedLen(hostHashSize) || strings.ToLower(host) != host {
+			return 0, false
+		}
+		if _, err := hex.DecodeString(host); err != nil {
+			return 0, false
+		}
+		key = idStr
+	}
+
+	id, err := strconv.ParseInt(key, 10, 64)
+	if err != nil || id <= 0 || strconv.FormatInt(id, 10) != key {
+		return 0, false
+	}
+	return id, true
+}
+
+// isArtifactComplete reports whether the given artifact directory was fully
+// extracted. Artifacts are extracted to a temporary directory that is renamed
+// into place afterwards, so the directory only exists once it's complete,
+// unless some files of the artifact were extracted on their own.
+func isArtifactComplete(dir string) bool {
+	if info, err := os.Stat(dir); err != nil || !info.IsDir() {
+		return false
+	}
+	_, err := os.Stat(dir + partialMarkerSuffix)
+	return os.IsNotExist(err)
+}
+
+// markArtifactPartial marks the given artifact directory as only containing
+// some files of the artifact. This must happen before the first file is
+// extracted to it.
+func markArtifactPartial(dir string) error {
+	if err := os.MkdirAll(filepath.Dir(dir), os.ModePerm); err != nil {
+		return err
+	}
+
+	file, err := os.Create(dir + partialMarkerSuffix)
+	if err != nil {
+		return err
+	}
+	return file.Close()
+}
+
+// createTempArtifactDir creates a temporary sibling directory of the given
+// artifact directory to extract the artifact to.
+func createTempArtifactDir(dir string) (string, error) {
+	if err := os.MkdirAll(filepath.Dir(dir), os.ModePerm); err != nil {
+		return "", err
+	}
+
+	tempDir, err := os.MkdirTemp(filepath.Dir(dir), filepath.Base(dir)+tempDirInfix+"*")
+	if err != nil {
+		return "", err
+	}
+	// MkdirTemp only grants access to the owner
+	if err := os.Chmod(tempDir, 0o755); err != nil {
+		os.RemoveAll(tempDir)
+		return "", err
+	}
+	return tempDir, nil
+}
+
+// replaceArtifactDir atomically moves the given temporary directory into place
+// as the given artifact directory, replacing any partial extraction of it.
+func replaceArtifactDir(tempDir string, dir string) error {
+	oldDir := getRemovalTempDir(dir)
+	if err := os.Rename(dir, oldDir); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err := os.Rename(tempDir, dir); err != nil {
+		return err
+	}
+	if err := os.Remove(dir + partialMarkerSuffix); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return os.RemoveAll(oldDir)
+}
+
+// isArtifactFileExtracted reports whether the given file of an artifact was
+// extracted on its own, without extracting the rest of the artifact.
+func isArtifactFileExtracted(dir string, filename string) bool {
+	if filename == "" {
+		return false
+	}
+
+	name := filepath.Join(dir, filepath.FromSlash(path.Clean("/"+filename)))
+	if ok, err := isWithinDir(dir, name); err != nil || !ok {
+		return false
+	}
+	info, err := os.Stat(name)
+	return err == nil && info.Mode().IsRegular()
+}
+
+// isArtifactProtected reports whether the given artifact directory belongs to
+// a target with access control.
+func isArtifactProtected(dir string) bool {
+	_, err := os.Stat(dir + protectedMarkerSuffix)
+	return err == nil
+}
+
+// markArtifactProtected marks the given artifact directory as belonging to a
+// target with access control.
+func markArtifactProtected(dir string) error {
+	// The marker may be created before the first artifact is downloaded
+	if err := os.MkdirAll(filepath.Dir(dir), os.ModePerm); err != nil {
+		return err
+	}
+
+	file, err := os.Create(dir + protectedMarkerSuffix)
+	if err != nil {
+		return err
+	}
+	return file.Close()
+}
+
+// removeArtifactDir removes the given artifact directory. It's renamed to a
+// temporary name first, so that a partially removed directory is never
+// considered to be complete. The protection marker is removed last, so that a
+// protected artifact is never exposed.
+func removeArtifactDir(dir string) error {
+	tempDir := getRemovalTempDir(dir)
+	if err := os.Rename(dir, tempDir); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err := os.Remove(dir + partialMarkerSuffix); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err := os.RemoveAll(tempDir); err != nil {
+		return err
+	}
+	if err := os.Remove(dir + protectedMarkerSuffix); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// getRemovalTempDir returns the temporary name that the given artifact
+// directory is renamed to before it's removed. Leftovers of an interrupted
+// removal are cleaned up by sweepIncompleteArtifacts.
+func getRemovalTempDir(dir string) string {
+	return fmt.Sprintf("%s%sremove-%d", dir, tempDirInfix, time.Now().UnixNano())
+}
+
+// prepareDownloadDir creates the given download directory if it doesn't exist
+// yet and checks that it's usable. The absolute path of the directory is
+// returned. The system's temporary directory and the root directory are
+// rejected, because the proxy removes files from the download directory.
+func prepareDownloadDir(dir string) (string, error) {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return "", err
+	}
+
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		return "", err
+	}
+
+	info, err := os.Stat(dir)
+	if err != nil {
+		return "", err
+	}
+	if !info.IsDir() {
+		return "", fmt.Errorf("not a directory: %s", dir)
+	}
+
+	realDir, err := filepath.EvalSymlinks(dir)
+	if err != nil {
+		return "", err
+	}
+	for _, forbidden := range []string{os.TempDir(), "/"} {
+		if realForbidden, err := filepath.EvalSymlinks(forbidden); err == nil && realForbidden == realDir {
+			return "", fmt.Errorf("refusing to use %s as the download directory", forbidden)
+		}
+	}
+
+	// Make sure we're able to write to the directory
+	file, err := os.CreateTemp(dir, ".write-check-*")
+	if err != nil {
+		return "", fmt.Errorf("directory is not writable: %w", err)
+	}
+	file.Close()
+	if err := os.Remove(file.Name()); err != nil {
+		return "", err
+	}
+
+	return dir, nil
+}
+
+// sweepTempZipFiles removes the artifact ZIP files in the given temporary
+// directory that were left behind, i.e. because the process crashed halfway
+// through a download.
+func sweepTempZipFiles(dir string) error {
+	files, err := filepath.Glob(filepath.Join(dir, "gh-artifact-*.zip"))
+	if err != nil {
+		return err
+	}
+
+	for _, file := range files {
+		log.WithField("file", file).Warn("removing leftover temporary zip file")
+		if err := os.Remove(file); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// sweepIncompleteArtifacts removes the temporary directories in the given
+// directory that artifacts were being extracted to or removed from, i.e.
+// because the process crashed halfway through, as well as any markers without
+// a directory.
+func sweepIncompleteArtifacts(dir string) error {
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	for _, file := range files {
+		path := filepath.Join(dir, file.Name())
+		if file.IsDir() {
+			if strings.Contains(file.Name(), tempDirInfix) {
+				log.WithField("dir", path).Warn("removing leftover temporary artifact directory")
+				if err := os.RemoveAll(path); err != nil {
+					return err
+				}
+			}
+		} else if artifactDir, ok := trimMarkerSuffix(path); ok {
+			if _, err := os.Stat(artifactDir); os.IsNotExist(err) {
+				if err := os.Remove(path); err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+// trimMarkerSuffix returns the artifact directory that the given marker file
+// belongs to.
+func trimMarkerSuffix(path string) (string, bool) {
+	for _, suffix := range []string{partialMarkerSuffix, protectedMarkerSuffix} {
+		if dir, ok := strings.CutSuffix(path, suffix); ok {
+			return dir, true
+		}
+	}
+	return "", false
+}
+
+func getDirSize(dir string) (int64, error) {
+	var size int64
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.Type().IsRegular() {
+			info, err := d.Info()
+			if err != nil {
+				return err
+			}
+			size += info.Size()
+		}
+		return nil
+	})
+	return size, err
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/fs"
+	"net/http"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// maxChecksumCacheEntries is the maximum number of checksums that are
+	// kept in memory. Computing them again is cheap compared to the download
+	// of an artifact, so the cache doesn't have to be exhaustive.
+	maxChecksumCacheEntries = 10000
+)
+
+// errChecksumDir is returned if the checksum of something other than a regular
+// file is requested.
+var errChecksumDir = errors.New("not a regular file")
+
+// checksumAlgorithms are the hash algorithms that clients can request the
+// checksum of an artifact file in.
+var checksumAlgorithms = map[string]func() hash.Hash{
+	"md5":    md5.New,
+	"sha1":   sha1.New,
+	"sha256": sha256.New,
+	"sha512": sha512.New,
+}
+
+type checksumInfo struct {
+	Path      string `json:"path"`
+	Algorithm string `json:"algorithm"`
+	Checksum  string `json:"checksum"`
+}
+
+// checksumCache keeps the checksums of artifact files that were computed
+// before. The contents of an artifact never change, so the entries never have
+// to be invalidated.
+type checksumCache struct {
+	m       sync.Mutex
+	entries map[string]string
+}
+
+func newChecksumCache() *checksumCache {
+	return &checksumCache{entries: make(map[string]string)}
+}
+
+func (c *checksumCache) Get(key string) (string, bool) {
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	sum, ok := c.entries[key]
+	return sum, ok
+}
+
+// Add adds the given checksum to the cache. If the cache is full, an arbitrary
+// entry is dropped to make room for it.
+func (c *checksumCache) Add(key string, sum string) {
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	if _, ok := c.entries[key]; !ok && len(c.entries) >= maxChecksumCacheEntries {
+		for evictKey := range c.entries {
+			delete(c.entries, evictKey)
+			break
+		}
+	}
+	c.entries[key] = sum
+}
+
+func getChecksumKey(artifactKey string, algorithm string, filename string) string {
+	return fmt.Sprintf("%s/%s/%s", artifactKey, algorithm, filename)
+}
+
+// requestsChecksum reports whether the client asked for the checksum of a file
+// instead of the file itself.
+func requestsChecksum(r *http.Request) bool {
+	return r.URL.Query().Has("checksum")
+}
+
+// serveChecksum serves the checksum of the given file of an extracted
+// artifact, in the algorithm that was passed in the checksum query parameter.
+// The response has the format of the output of tools like sha256sum, so that
+// it can be checked with those, unless JSON was requested. The given file system
+// is the root of the artifact as served for the given target.
+func (s *Server) serveChecksum(w http.ResponseWriter, r *http.Request, logCtx *log.Entry, target *Target, artifactID int64, fsys fs.FS, filename string) {
+	algorithm := strings.ToLower(r.URL.Query().Get("checksum"))
+	if algorithm == "" {
+		algorithm = "sha256"
+	}
+	logCtx = logCtx.WithField("checksum", algorithm)
+
+	newHash, ok := checksumAlgorithms[algorithm]
+	if !ok {
+		logCtx.Warn("unsupported checksum algorithm")
+		httpErrorDetail(w, r, http.StatusBadRequest, fmt.Sprintf("unsupported checksum algorithm, expected one of: %s", strings.Join(getChecksumAlgorithms(), ", ")))
+		return
+	}
+
+	name := path.Clean(filename)
+	if filename == "" || strings.HasSuffix(filename, "/") || !fs.ValidPath(name) {
+		httpErrorDetail(w, r, http.StatusBadRequest, "checksums can only be computed for files")
+		return
+	}
+
+	key := getChecksumKey(target.getArtifactKey(artifactID), algorithm, target.getArtifactPath(name))
+	sum, ok := s.checksums.Get(key)
+	if !ok {
+		var err error
+		if sum, err = computeChecksum(fsys, name, newHash()); err != nil {
+			switch {
+			case errors.Is(err, fs.ErrNotExist):
+				logCtx.WithError(err).Warn("unable to compute checksum of artifact file")
+				httpError(w, r, http.StatusNotFound)
+			case errors.Is(err, errChecksumDir):
+				httpErrorDetail(w, r, http.StatusBadRequest, "checksums can only be computed for files")
+			default:
+				logCtx.WithError(err).Error("unable to compute checksum of artifact file")
+				httpError(w, r, http.StatusInternalServerError)
+			}
+			return
+		}
+		s.checksums.Add(key, sum)
+	}
+
+	logCtx.Info("serving checksum of artifact file")
+	writeCacheHeaders(w)
+	w.Header().Add("Vary", "Accept")
+	if requestsJSON(r) {
+		writeJSON(w, logCtx, http.StatusOK, &checksumInfo{
+			Path:      name,
+			Algorithm: algorithm,
+			Checksum:  sum,
+		})
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	fmt.Fprintf(w, "%s  %s\n", sum, path.Base(name))
+}
+
+// computeChecksum returns the hex-encoded checksum of the given file.
+func computeChecksum(fsys fs.FS, name string, h hash.Hash) (string, error) {
+	file, err := fsys.Open(name)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return "", err
+	}
+	if !info.Mode().IsRegular() {
+		return "", fmt.Errorf("%w: %s", errChecksumDir, name)
+	}
+
+	if _, err := io.Copy(h, file); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+func getChecksumAlgorithms() []string {
+	algorithms := make([]string, 0, len(checksumAlgorithms))
+	for algorithm := range checksumAlgorithms {
+		algorithms = append(algorithms, algorithm)
+	}
+	sort.Strings(algorithms)
+	return algorithms
+}
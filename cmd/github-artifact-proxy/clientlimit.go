@@ -0,0 +1,140 @@
+package main
+
+import (
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// clientLimiterSweepInterval is the minimum interval at which the buckets
+	// of clients that are back at their full burst are dropped.
+	clientLimiterSweepInterval = time.Minute
+)
+
+// clientLimiter limits the rate of requests per client IP address with a token
+// bucket for every client.
+type clientLimiter struct {
+	m         sync.Mutex
+	rate      float64 // tokens per second
+	burst     float64
+	buckets   map[string]*clientBucket
+	lastSweep time.Time
+}
+
+type clientBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// newClientLimiter returns a limiter that allows the given amount of requests
+// per minute per client, with bursts of up to the given size.
+func newClientLimiter(perMinute int, burst int) *clientLimiter {
+	if burst <= 0 {
+		burst = perMinute
+	}
+	return &clientLimiter{
+		rate:      float64(perMinute) / 60,
+		burst:     float64(burst),
+		buckets:   make(map[string]*clientBucket),
+		lastSweep: time.Now(),
+	}
+}
+
+// Allow takes a token from the bucket of the given client. If the bucket is
+// empty, false is returned along with the time until the next token is
+// available.
+func (l *clientLimiter) Allow(client string) (bool, time.Duration) {
+	l.m.Lock()
+	defer l.m.Unlock()
+
+	now := time.Now()
+	if now.Sub(l.lastSweep) >= clientLimiterSweepInterval {
+		l.sweep(now)
+	}
+
+	bucket, ok := l.buckets[client]
+	if !ok {
+		bucket = &clientBucket{tokens: l.burst, last: now}
+		l.buckets[client] = bucket
+	}
+	bucket.tokens = l.refill(bucket, now)
+	bucket.last = now
+
+	if bucket.tokens < 1 {
+		wait := time.Duration((1 - bucket.tokens) / l.rate * float64(time.Second))
+		return false, wait
+	}
+	bucket.tokens--
+	return true, 0
+}
+
+func (l *clientLimiter) refill(bucket *clientBucket, now time.Time) float64 {
+	return math.Min(l.burst, bucket.tokens+now.Sub(bucket.last).Seconds()*l.rate)
+}
+
+// sweep drops the buckets that are full again, as they're no different from a
+// new bucket. This keeps the amount of buckets bounded by the amount of recent
+// clients.
+func (l *clientLimiter) sweep(now time.Time) {
+	for client, bucket := range l.buckets {
+		if l.refill(bucket, now) >= l.burst {
+			delete(l.buckets, client)
+		}
+	}
+	l.lastSweep = now
+}
+
+// checkClientRateLimit reports whether the given request is within the rate
+// limit of its client. If it's not, a 429 response is written. Requests for the
+// health checks and the metrics are never limited.
+func (s *Server) checkClientRateLimit(w http.ResponseWriter, r *http.Request) bool {
+	if s.clientLimiter == nil || s.isPolledPath(r.URL.Path) {
+		return true
+	}
+
+	client := s.getClientIP(r)
+	ok, retryAfter := s.clientLimiter.Allow(client)
+	if ok {
+		return true
+	}
+
+	requestLogger(r.Context()).WithFields(log.Fields{
+		"addr":        r.RemoteAddr,
+		"client":      client,
+		"path":        r.URL.Path,
+		"retry_after": retryAfter,
+	}).Warn("client exceeded the rate limit")
+
+	clientRateLimitedTotal.Inc()
+	w.Header().Set("Retry-After", strconv.FormatInt(int64(math.Ceil(retryAfter.Seconds())), 10))
+	httpError(w, r, http.StatusTooManyRequests)
+	return false
+}
+
+// getClientIP returns the IP address of the client of the given request. If
+// forwarded headers are trusted, the last address in X-Forwarded-For is used,
+// as that's the one that the reverse proxy in front of us appended. Any
+// earlier addresses could have been made up by the client.
+func (s *Server) getClientIP(r *http.Request) string {
+	if s.TrustForwarded {
+		if values := r.Header.Values("X-Forwarded-For"); len(values) > 0 {
+			addrs := strings.Split(values[len(values)-1], ",")
+			if addr := strings.TrimSpace(addrs[len(addrs)-1]); addr != "" {
+				return addr
+			}
+		}
+	}
+
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
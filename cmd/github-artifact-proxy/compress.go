@@ -0,0 +1,168 @@
+package main
+
+import (
+	"compress/gzip"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/andybalholm/brotli"
+)
+
+const (
+	// compressMinSize is the minimum size in bytes of a response body with a
+	// known length for it to be compressed.
+	compressMinSize = 1024
+	// compressBrotliLevel trades some compression ratio for speed, because
+	// responses are compressed on the fly
+	compressBrotliLevel = 4
+)
+
+// compressibleTypes are the media types that are compressed in addition to
+// all text/* types.
+var compressibleTypes = map[string]bool{
+	"application/javascript": true,
+	"application/json":       true,
+	"application/x-ndjson":   true,
+	"application/xml":        true,
+	"application/xhtml+xml":  true,
+	"image/svg+xml":          true,
+}
+
+// compressResponseWriter compresses the response body with the given encoding
+// if the response turns out to be compressible once the headers are written.
+type compressResponseWriter struct {
+	http.ResponseWriter
+	r *http.Request
+	// encoding is the content encoding negotiated with the client, or empty
+	// if the client doesn't support any
+	encoding    string
+	encoder     io.WriteCloser
+	wroteHeader bool
+}
+
+// withCompression wraps the given response writer so that compressible
+// responses are compressed with gzip or brotli, depending on what the client
+// supports. The returned function must be called once the response is
+// written.
+func withCompression(w http.ResponseWriter, r *http.Request) (http.ResponseWriter, func()) {
+	cw := &compressResponseWriter{
+		ResponseWriter: w,
+		r:              r,
+		encoding:       negotiateEncoding(r.Header.Get("Accept-Encoding")),
+	}
+	return cw, cw.close
+}
+
+func (w *compressResponseWriter) WriteHeader(status int) {
+	if w.wroteHeader {
+		w.ResponseWriter.WriteHeader(status)
+		return
+	}
+	w.wroteHeader = true
+
+	header := w.Header()
+	if status == http.StatusOK && w.r.Method != http.MethodHead && w.r.Header.Get("Range") == "" &&
+		header.Get("Content-Encoding") == "" && isCompressible(header.Get("Content-Type")) {
+		header.Add("Vary", "Accept-Encoding")
+
+		size, err := strconv.ParseInt(header.Get("Content-Length"), 10, 64)
+		if w.encoding != "" && (err != nil || size >= compressMinSize) {
+			header.Del("Content-Length")
+			header.Del("Accept-Ranges")
+			header.Set("Content-Encoding", w.encoding)
+
+			// The compressed representation is not byte-for-byte identical
+			if etag := header.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+				header.Set("ETag", "W/"+etag)
+			}
+
+			switch w.encoding {
+			case "br":
+				w.encoder = brotli.NewWriterLevel(w.ResponseWriter, compressBrotliLevel)
+			case "gzip":
+				w.encoder = gzip.NewWriter(w.ResponseWriter)
+			}
+		}
+	}
+
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *compressResponseWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	if w.encoder != nil {
+		return w.encoder.Write(b)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// ReadFrom keeps the underlying response writer's ability to use sendfile for
+// responses that aren't compressed.
+func (w *compressResponseWriter) ReadFrom(r io.Reader) (int64, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	if w.encoder != nil {
+		return io.Copy(w.encoder, r)
+	}
+	if rf, ok := w.ResponseWriter.(io.ReaderFrom); ok {
+		return rf.ReadFrom(r)
+	}
+	return io.Copy(w.ResponseWriter, r)
+}
+
+func (w *compressResponseWriter) Flush() {
+	if w.encoder != nil {
+		if f, ok := w.encoder.(interface{ Flush() error }); ok {
+			f.Flush()
+		}
+	}
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (w *compressResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+func (w *compressResponseWriter) close() {
+	if w.encoder != nil {
+		w.encoder.Close()
+	}
+}
+
+// negotiateEncoding returns the preferred content encoding that is supported
+// according to the given Accept-Encoding header, or an empty string if none.
+func negotiateEncoding(header string) string {
+	accepted := make(map[string]bool)
+	for _, part := range strings.Split(header, ",") {
+		coding, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		if q, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			if value, err := strconv.ParseFloat(q, 64); err == nil && value == 0 {
+				continue
+			}
+		}
+		accepted[strings.ToLower(strings.TrimSpace(coding))] = true
+	}
+
+	for _, encoding := range []string{"br", "gzip"} {
+		if accepted[encoding] {
+			return encoding
+		}
+	}
+	return ""
+}
+
+func isCompressible(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	return strings.HasPrefix(mediaType, "text/") || compressibleTypes[mediaType]
+}
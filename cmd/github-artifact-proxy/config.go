@@ -2,85 +2,694 @@ package main
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io/fs"
+	"net/url"
 	"os"
+	"path"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/google/go-github/v60/github"
 	"gopkg.in/yaml.v3"
 )
 
+// headerNameRegex matches valid HTTP header names (RFC 9110 tokens).
+var headerNameRegex = regexp.MustCompile("^[!#$%&'*+.^_`|~0-9A-Za-z-]+$")
+
+const (
+	// targetTypeActions targets serve the artifacts of GitHub Actions workflow
+	// runs
+	targetTypeActions = "actions"
+	// targetTypeRelease targets serve the assets of GitHub releases
+	targetTypeRelease = "release"
+)
+
+var envVarRegex = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+
 type Run struct {
-	ID        int64
-	Artifacts []*github.Artifact
-	FetchTime time.Time
+	ID        int64              `json:"id"`
+	Artifacts []*github.Artifact `json:"artifacts"`
+	FetchTime time.Time          `json:"fetch_time"`
 }
 
 type LatestFilter struct {
-	Branch *string `yaml:"branch"`
-	Event  *string `yaml:"event"`
-	Status *string `yaml:"status"`
+	Branch *string `yaml:"branch" json:"branch,omitempty"`
+	Event  *string `yaml:"event" json:"event,omitempty"`
+	Status *string `yaml:"status" json:"status,omitempty"`
+	// Conclusion is matched against the most recent workflow runs by the
+	// proxy itself, rather than by the GitHub API
+	Conclusion *string `yaml:"conclusion" json:"conclusion,omitempty"`
 }
 
 type Target struct {
-	Token        *string       `yaml:"token"`
-	Owner        string        `yaml:"owner"`
-	Repo         string        `yaml:"repo"`
-	Filename     string        `yaml:"filename"`
-	LatestFilter *LatestFilter `yaml:"latest_filter"`
+	// Type is either "actions" (the default) or "release"
+	Type         string         `yaml:"type"`
+	Token        *string        `yaml:"token"`
+	BaseURL      *string        `yaml:"base_url"`
+	Owner        string         `yaml:"owner"`
+	Repo         string         `yaml:"repo"`
+	Filenames    stringList     `yaml:"filename"`
+	LatestFilter *LatestFilter  `yaml:"latest_filter"`
+	CacheTTL     *string        `yaml:"cache_ttl"`
+	MaxSize      *string        `yaml:"max_artifact_size"`
+	Access       *AccessControl `yaml:"access"`
+	// CaseInsensitive enables matching artifact names regardless of case
+	CaseInsensitive bool `yaml:"case_insensitive"`
+	// Headers are added to the responses for the target
+	Headers map[string]string `yaml:"headers"`
+	// AllowClientToken makes the proxy use the GitHub token in the
+	// Authorization header of each request, instead of a configured token
+	AllowClientToken bool `yaml:"allow_client_token"`
+	// Enabled can be set to false to ignore the target without removing it
+	// from the config file
+	Enabled *bool `yaml:"enabled"`
+	// StripPrefix is a directory inside the artifacts of the target that file
+	// names are resolved relative to
+	StripPrefix string `yaml:"strip_prefix"`
+	// FallbackFile is served instead of requested files that don't exist in
+	// an artifact, like the index.html of a single-page app
+	FallbackFile string `yaml:"fallback_file"`
+	// RefreshInterval enables looking up the latest workflow run of the
+	// target in the background at this interval, and downloading its
+	// artifacts ahead of the requests for them
+	RefreshInterval *string `yaml:"refresh_interval"`
+	// ArtifactID pins the target to the artifact with this ID, which is
+	// served as the artifact of the latest run without looking up any
+	// workflow runs
+	ArtifactID *int64 `yaml:"artifact_id"`
+
+	runCache        *runCache
+	token           *Token
+	cacheTTL        time.Duration
+	maxSize         int64
+	refreshInterval time.Duration
+}
+
+// stringList is a list of strings that can also be written as a single string
+// in the config file.
+type stringList []string
+
+func (l *stringList) UnmarshalYAML(node *yaml.Node) error {
+	if node.Kind == yaml.ScalarNode {
+		var s string
+		if err := node.Decode(&s); err != nil {
+			return err
+		}
+		*l = stringList{s}
+		return nil
+	}
 
-	lockChan chan struct{}
-	runCache map[string]*Run
+	var list []string
+	if err := node.Decode(&list); err != nil {
+		return err
+	}
+	*l = list
+	return nil
+}
+
+// MarshalJSON writes a list with a single string as just that string, like in
+// the config file.
+func (l stringList) MarshalJSON() ([]byte, error) {
+	if len(l) == 1 {
+		return json.Marshal(l[0])
+	}
+	return json.Marshal([]string(l))
+}
+
+func (l stringList) String() string {
+	return strings.Join(l, ", ")
 }
 
 type Webhook struct {
 	Path   string `yaml:"path"`
 	Secret string `yaml:"secret"`
+	// BearerToken is accepted in the Authorization header of requests without
+	// a signature, for senders that can't compute one.
+	BearerToken string `yaml:"bearer_token"`
+	// Prefetch enables downloading the artifacts of the latest workflow run
+	// of the targets that a completed workflow run event invalidated.
+	Prefetch bool `yaml:"prefetch"`
 }
 
 type Config struct {
-	Webhook *Webhook
-	Tokens  map[string]string  `yaml:"tokens"`
-	Targets map[string]*Target `yaml:"targets"`
+	Webhook      *Webhook
+	Auth         *Auth              `yaml:"auth"`
+	Purge        *Purge             `yaml:"purge"`
+	CORS         *CORS              `yaml:"cors"`
+	ContentTypes map[string]string  `yaml:"content_types"`
+	Tokens       map[string]*Token  `yaml:"tokens"`
+	Targets      map[string]*Target `yaml:"targets"`
+	Dynamic      *Dynamic           `yaml:"dynamic"`
+	// AllowedRepos restricts the repositories that targets can point to, as a
+	// guard against misconfigured targets. See matchRepoPatterns.
+	AllowedRepos stringList `yaml:"allowed_repos"`
+
+	contentTypes map[string]string
 }
 
-func (t *Target) Lock(ctx context.Context) error {
-	select {
-	case t.lockChan <- struct{}{}:
-		return nil
-	case <-ctx.Done():
-		return ctx.Err()
+// hasSameWorkflow reports whether both targets point to the same workflow and
+// select the latest run in the same way, i.e. whether they can share a run
+// cache.
+func (t *Target) hasSameWorkflow(o *Target) bool {
+	return t.Type == o.Type &&
+		t.Owner == o.Owner &&
+		t.Repo == o.Repo &&
+		slices.Equal(t.Filenames, o.Filenames) &&
+		equalStringPtrs(t.BaseURL, o.BaseURL) &&
+		reflect.DeepEqual(t.LatestFilter, o.LatestFilter) &&
+		reflect.DeepEqual(t.ArtifactID, o.ArtifactID)
+}
+
+// LoadConfig loads the config from the given comma-separated list of files and
+// directories. Directories are expanded to the YAML files in them. If there are
+// multiple files, they're merged in order with mergeConfigNodes before the
+// result is validated.
+func LoadConfig(paths string) (*Config, error) {
+	filenames, err := getConfigFiles(paths)
+	if err != nil {
+		return nil, err
+	}
+
+	var node *yaml.Node
+	for _, filename := range filenames {
+		fileNode, err := readConfigFile(filename)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", filename, err)
+		}
+
+		if node == nil {
+			node = fileNode
+		} else if err := mergeConfigNodes(node, fileNode); err != nil {
+			return nil, fmt.Errorf("%s: %w", filename, err)
+		}
+	}
+
+	var config Config
+	if err := node.Decode(&config); err != nil {
+		return nil, err
+	}
+
+	if config.Webhook != nil {
+		if config.Webhook.Path == "" {
+			return nil, fmt.Errorf("webhook requires a path")
+		}
+		if config.Webhook.Secret == "" && config.Webhook.BearerToken == "" {
+			return nil, fmt.Errorf("webhook requires a secret or a bearer token")
+		}
+	}
+
+	if config.Auth != nil {
+		if len(config.Auth.BasicAuth) == 0 {
+			return nil, fmt.Errorf("auth requires at least one user")
+		}
+		for user, pass := range config.Auth.BasicAuth {
+			if pass == "" {
+				return nil, fmt.Errorf("auth has an empty password for user '%s'", user)
+			}
+		}
+	}
+
+	if config.Purge != nil && config.Purge.Secret == "" {
+		return nil, fmt.Errorf("purge requires a secret")
+	}
+
+	if config.CORS != nil {
+		if err := config.CORS.validate(); err != nil {
+			return nil, fmt.Errorf("cors: %w", err)
+		}
+	}
+
+	config.contentTypes, err = parseContentTypes(config.ContentTypes)
+	if err != nil {
+		return nil, fmt.Errorf("content_types: %w", err)
+	}
+
+	for id, token := range config.Tokens {
+		if token == nil || (token.Value == "" && !token.canRefresh() && token.App == nil) {
+			return nil, fmt.Errorf("token '%s' requires a value, a refresh command, a file or a GitHub App", id)
+		}
+		if token.File != "" && (token.Value != "" || len(token.RefreshCommand) > 0) {
+			return nil, fmt.Errorf("token '%s' can't have both a file and a value or refresh command", id)
+		}
+
+		if token.CacheTTL != nil {
+			ttl, err := time.ParseDuration(*token.CacheTTL)
+			if err != nil {
+				return nil, fmt.Errorf("token '%s' has an invalid cache TTL: %w", id, err)
+			}
+			token.cacheTTL = ttl
+		}
+
+		if token.App != nil {
+			if err := token.App.load(); err != nil {
+				return nil, fmt.Errorf("token '%s' has an invalid GitHub App: %w", id, err)
+			}
+			continue
+		}
+
+		if token.Value == "" {
+			value, err := token.fetch(context.Background())
+			if err != nil {
+				return nil, fmt.Errorf("unable to fetch token '%s': %w", id, err)
+			}
+			token.Value = value
+		}
+	}
+
+	if err := validateRepoPatterns(config.AllowedRepos); err != nil {
+		return nil, fmt.Errorf("allowed_repos: %w", err)
 	}
+
+	for id, target := range config.Targets {
+		// Disabled targets don't need to be valid, as they're dropped entirely
+		if target.Enabled != nil && !*target.Enabled {
+			delete(config.Targets, id)
+			continue
+		}
+
+		target.runCache = newRunCache()
+
+		if len(config.AllowedRepos) > 0 && !matchRepoPatterns(config.AllowedRepos, target.Owner, target.Repo) {
+			return nil, fmt.Errorf("target '%s' points to repository '%s/%s', which isn't in the allowed repositories", id, target.Owner, target.Repo)
+		}
+
+		// These use the Authorization header of the request as well
+		if config.Auth != nil && (target.Access != nil || target.AllowClientToken) {
+			return nil, fmt.Errorf("target '%s' can't have access control or allow client tokens if auth is configured", id)
+		}
+
+		if target.AllowClientToken {
+			if target.Token != nil {
+				return nil, fmt.Errorf("target '%s' can't have both an API token and allow client tokens", id)
+			}
+			// Both use the Authorization header of the request
+			if target.Access != nil {
+				return nil, fmt.Errorf("target '%s' can't have both access control and allow client tokens", id)
+			}
+		} else {
+			if target.Token == nil {
+				return nil, fmt.Errorf("target '%s' requires an API token", id)
+			}
+
+			token, ok := config.Tokens[*target.Token]
+			if !ok {
+				return nil, fmt.Errorf("token with id '%s' not found in tokens list", *target.Token)
+			}
+			target.token = token
+		}
+
+		for _, filename := range target.Filenames {
+			if filename == "" {
+				return nil, fmt.Errorf("target '%s' has an empty workflow filename", id)
+			}
+		}
+
+		switch target.Type {
+		case "", targetTypeActions:
+		case targetTypeRelease:
+			if len(target.Filenames) > 0 || target.LatestFilter != nil {
+				return nil, fmt.Errorf("target '%s' of type release can't have a filename or latest filter", id)
+			}
+			if target.StripPrefix != "" {
+				return nil, fmt.Errorf("target '%s' of type release can't have a prefix to strip", id)
+			}
+		default:
+			return nil, fmt.Errorf("target '%s' has an invalid type: '%s' (expected actions or release)", id, target.Type)
+		}
+
+		if target.ArtifactID != nil {
+			if target.isRelease() {
+				return nil, fmt.Errorf("target '%s' of type release can't be pinned to an artifact", id)
+			}
+			if len(target.Filenames) > 0 || target.LatestFilter != nil {
+				return nil, fmt.Errorf("target '%s' pinned to an artifact can't have a filename or latest filter", id)
+			}
+			if *target.ArtifactID <= 0 {
+				return nil, fmt.Errorf("target '%s' has an invalid artifact ID: %d", id, *target.ArtifactID)
+			}
+		}
+
+		if target.StripPrefix != "" {
+			prefix := strings.Trim(target.StripPrefix, "/")
+			if !fs.ValidPath(prefix) || prefix == "." {
+				return nil, fmt.Errorf("target '%s' has an invalid prefix to strip: '%s'", id, target.StripPrefix)
+			}
+			target.StripPrefix = prefix
+		}
+
+		if target.FallbackFile != "" {
+			if target.isRelease() {
+				return nil, fmt.Errorf("target '%s' of type release can't have a fallback file", id)
+			}
+			fallback := strings.Trim(target.FallbackFile, "/")
+			if !fs.ValidPath(fallback) || fallback == "." {
+				return nil, fmt.Errorf("target '%s' has an invalid fallback file: '%s'", id, target.FallbackFile)
+			}
+			target.FallbackFile = fallback
+		}
+
+		if target.CacheTTL != nil {
+			ttl, err := time.ParseDuration(*target.CacheTTL)
+			if err != nil {
+				return nil, fmt.Errorf("target '%s' has an invalid cache TTL: %w", id, err)
+			}
+			target.cacheTTL = ttl
+		}
+
+		if target.RefreshInterval != nil {
+			if target.AllowClientToken || target.isRelease() {
+				return nil, fmt.Errorf("target '%s' can't have a refresh interval if it allows client tokens or is of type release", id)
+			}
+			interval, err := time.ParseDuration(*target.RefreshInterval)
+			if err != nil {
+				return nil, fmt.Errorf("target '%s' has an invalid refresh interval: %w", id, err)
+			}
+			if interval < minRefreshInterval {
+				return nil, fmt.Errorf("target '%s' has a refresh interval shorter than %s", id, minRefreshInterval)
+			}
+			target.refreshInterval = interval
+		}
+
+		if target.MaxSize != nil {
+			size, err := ParseByteSize(*target.MaxSize)
+			if err != nil {
+				return nil, fmt.Errorf("target '%s' has an invalid maximum artifact size: %w", id, err)
+			}
+			target.maxSize = int64(size)
+		}
+
+		for name, value := range target.Headers {
+			if !headerNameRegex.MatchString(name) {
+				return nil, fmt.Errorf("target '%s' has an invalid header name: '%s'", id, name)
+			}
+			if strings.ContainsAny(value, "\r\n") {
+				return nil, fmt.Errorf("target '%s' has an invalid value for header '%s'", id, name)
+			}
+		}
+
+		if target.BaseURL != nil {
+			u, err := url.Parse(*target.BaseURL)
+			if err != nil {
+				return nil, fmt.Errorf("target '%s' has an invalid base URL: %w", id, err)
+			}
+			if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+				return nil, fmt.Errorf("target '%s' has an invalid base URL: '%s' (expected an absolute http(s) URL)", id, *target.BaseURL)
+			}
+		}
+	}
+
+	if config.Dynamic != nil {
+		if err := config.Dynamic.validate(config.Tokens); err != nil {
+			return nil, fmt.Errorf("dynamic: %w", err)
+		}
+	}
+
+	return &config, err
 }
 
-func (t *Target) Unlock() {
-	<-t.lockChan
+// validateRepoPatterns checks that the given repository patterns are either
+// "owner/repo" or just "owner", where both parts can contain wildcards.
+func validateRepoPatterns(patterns []string) error {
+	for _, pattern := range patterns {
+		owner, repo, hasRepo := strings.Cut(pattern, "/")
+		if !isValidRepoPattern(owner) || (hasRepo && (!isValidRepoPattern(repo) || strings.Contains(repo, "/"))) {
+			return fmt.Errorf("invalid repository: '%s' (expected owner or owner/repo)", pattern)
+		}
+	}
+	return nil
+}
+
+func isValidRepoPattern(pattern string) bool {
+	if pattern == "" {
+		return false
+	}
+	_, err := path.Match(pattern, "")
+	return err == nil
 }
 
-func LoadConfig(filename string) (*Config, error) {
+// matchRepoPatterns reports whether the given repository matches any of the
+// given patterns. A pattern is either "owner/repo", or just "owner" to match
+// all of its repositories. Both parts can contain the wildcards supported by
+// path.Match (e.g. "alexbakker/menta-*"). Like on GitHub, the names are
+// matched regardless of case.
+func matchRepoPatterns(patterns []string, owner string, repo string) bool {
+	owner = strings.ToLower(owner)
+	repo = strings.ToLower(repo)
+	for _, pattern := range patterns {
+		ownerPattern, repoPattern, hasRepo := strings.Cut(strings.ToLower(pattern), "/")
+		if ok, _ := path.Match(ownerPattern, owner); !ok {
+			continue
+		}
+		if ok, _ := path.Match(repoPattern, repo); !hasRepo || ok {
+			return true
+		}
+	}
+	return false
+}
+
+// getArtifactPath returns the path inside the artifacts of the target that the
+// given requested file name refers to, taking the prefix to strip into
+// account.
+func (t *Target) getArtifactPath(filename string) string {
+	if t.StripPrefix == "" {
+		return filename
+	}
+	return t.StripPrefix + "/" + filename
+}
+
+// resolveFallbackFile returns the fallback file of the target if the
+// requested file doesn't exist in the given artifact, in which case true is
+// returned as well. Otherwise, the requested file is returned as is.
+func (t *Target) resolveFallbackFile(fsys fs.FS, filename string) (string, bool) {
+	if t.FallbackFile == "" || filename == "" {
+		return filename, false
+	}
+	if _, err := fs.Stat(fsys, path.Clean(filename)); !errors.Is(err, fs.ErrNotExist) {
+		return filename, false
+	}
+	return t.FallbackFile, true
+}
+
+// isRelease reports whether the target serves the assets of GitHub releases
+// instead of workflow run artifacts.
+func (t *Target) isRelease() bool {
+	return t.Type == targetTypeRelease
+}
+
+// isPinned reports whether the target always serves the same artifact, instead
+// of the artifacts of its workflow runs.
+func (t *Target) isPinned() bool {
+	return t.ArtifactID != nil
+}
+
+func (t *Target) getType() string {
+	if t.Type == "" {
+		return targetTypeActions
+	}
+	return t.Type
+}
+
+// isProtected reports whether access to the target is restricted, in which
+// case its artifacts must never be exposed through the file server.
+func (t *Target) isProtected() bool {
+	return t.Access != nil || t.AllowClientToken
+}
+
+// serveInline reports whether the files of the target must be served directly
+// instead of through a redirect to the file server, which is shared by all
+// targets.
+func (t *Target) serveInline() bool {
+	return t.isProtected() || len(t.Headers) > 0
+}
+
+// getArtifactKey returns the key of the artifact (or release asset) of the
+// target with the given ID in the caches. IDs are only unique per GitHub host,
+// so for hosts other than github.com (e.g. GitHub Enterprise Server), the key
+// is prefixed with a hash of the host of the base URL.
+func (t *Target) getArtifactKey(id int64) string {
+	key := strconv.FormatInt(id, 10)
+	if t.BaseURL == nil {
+		return key
+	}
+
+	// The base URL was validated when the config was loaded
+	u, err := url.Parse(*t.BaseURL)
+	if err != nil {
+		return key
+	}
+	host := strings.ToLower(u.Host)
+	if host == "api.github.com" || host == "github.com" {
+		return key
+	}
+
+	sum := sha256.Sum256([]byte(host))
+	return hex.EncodeToString(sum[:hostHashSize]) + "-" + key
+}
+
+func equalStringPtrs(a *string, b *string) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return *a == *b
+}
+
+// getConfigFiles returns the config files in the given comma-separated list of
+// files and directories. Directories are expanded to the .yml and .yaml files
+// in them, in lexical order.
+func getConfigFiles(paths string) ([]string, error) {
+	var filenames []string
+	for _, path := range strings.Split(paths, ",") {
+		if path = strings.TrimSpace(path); path == "" {
+			continue
+		}
+
+		info, err := os.Stat(path)
+		if err != nil {
+			return nil, err
+		}
+		if !info.IsDir() {
+			filenames = append(filenames, path)
+			continue
+		}
+
+		entries, err := os.ReadDir(path)
+		if err != nil {
+			return nil, err
+		}
+		var found bool
+		for _, entry := range entries {
+			if ext := filepath.Ext(entry.Name()); entry.Type().IsRegular() && (ext == ".yml" || ext == ".yaml") {
+				filenames = append(filenames, filepath.Join(path, entry.Name()))
+				found = true
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("no config files found in directory: %s", path)
+		}
+	}
+
+	if len(filenames) == 0 {
+		return nil, fmt.Errorf("no config files given")
+	}
+	return filenames, nil
+}
+
+// readConfigFile parses the given config file, with references to environment
+// variables expanded.
+func readConfigFile(filename string) (*yaml.Node, error) {
 	file, err := os.Open(filename)
 	if err != nil {
 		return nil, err
 	}
 	defer file.Close()
 
-	var config Config
-	if err := yaml.NewDecoder(file).Decode(&config); err != nil {
+	var node yaml.Node
+	if err := yaml.NewDecoder(file).Decode(&node); err != nil {
 		return nil, err
 	}
+	if err := expandEnv(&node); err != nil {
+		return nil, err
+	}
+	return &node, nil
+}
 
-	for id, target := range config.Targets {
-		target.lockChan = make(chan struct{}, 1)
-		target.runCache = make(map[string]*Run)
+// mergeConfigNodes merges the top-level sections of the config document src
+// into dst. Sections that are mappings in both, like tokens and targets, are
+// merged entry by entry, with the entries of src replacing those with the same
+// key in dst. Any other section of src replaces the one in dst entirely.
+func mergeConfigNodes(dst *yaml.Node, src *yaml.Node) error {
+	dstRoot, srcRoot := dst.Content[0], src.Content[0]
+	if dstRoot.Kind != yaml.MappingNode || srcRoot.Kind != yaml.MappingNode {
+		return fmt.Errorf("config files to merge must contain a mapping")
+	}
 
-		if target.Token == nil {
-			return nil, fmt.Errorf("target '%s' requires an API token", id)
+	for i := 0; i < len(srcRoot.Content); i += 2 {
+		key, value := srcRoot.Content[i], srcRoot.Content[i+1]
+		if section := getMappingValue(dstRoot, key.Value); section != nil && section.Kind == yaml.MappingNode && value.Kind == yaml.MappingNode {
+			for j := 0; j < len(value.Content); j += 2 {
+				setMappingValue(section, value.Content[j], value.Content[j+1])
+			}
+			continue
 		}
+		setMappingValue(dstRoot, key, value)
+	}
 
-		if _, ok := config.Tokens[*target.Token]; !ok {
-			return nil, fmt.Errorf("token with id '%s' not found in tokens list", *target.Token)
+	return nil
+}
+
+// getMappingValue returns the value of the given key in the given mapping node,
+// or nil if the key is not there.
+func getMappingValue(node *yaml.Node, key string) *yaml.Node {
+	for i := 0; i < len(node.Content); i += 2 {
+		if node.Content[i].Value == key {
+			return node.Content[i+1]
 		}
 	}
+	return nil
+}
 
-	return &config, err
+// setMappingValue sets the value of the given key in the given mapping node,
+// replacing the existing value if the key is already there.
+func setMappingValue(node *yaml.Node, key *yaml.Node, value *yaml.Node) {
+	for i := 0; i < len(node.Content); i += 2 {
+		if node.Content[i].Value == key.Value {
+			node.Content[i+1] = value
+			return
+		}
+	}
+	node.Content = append(node.Content, key, value)
+}
+
+// expandEnv replaces references to environment variables of the form ${NAME}
+// in the scalar values of the given YAML node. Mapping keys are left alone. An
+// error is returned if a referenced variable is not set.
+func expandEnv(node *yaml.Node) error {
+	switch node.Kind {
+	case yaml.DocumentNode, yaml.SequenceNode:
+		for _, child := range node.Content {
+			if err := expandEnv(child); err != nil {
+				return err
+			}
+		}
+	case yaml.MappingNode:
+		for i := 1; i < len(node.Content); i += 2 {
+			if err := expandEnv(node.Content[i]); err != nil {
+				return err
+			}
+		}
+	case yaml.ScalarNode:
+		var err error
+		value := envVarRegex.ReplaceAllStringFunc(node.Value, func(ref string) string {
+			name := envVarRegex.FindStringSubmatch(ref)[1]
+			value, ok := os.LookupEnv(name)
+			if !ok && err == nil {
+				err = fmt.Errorf("line %d: environment variable '%s' is not set", node.Line, name)
+			}
+			return value
+		})
+		if err != nil {
+			return err
+		}
+
+		if value != node.Value {
+			node.Value = value
+			// Let unquoted values be resolved to the type of their expanded
+			// value, so that numbers can be taken from the environment as well
+			if node.Style == 0 {
+				node.Tag = ""
+			}
+		}
+	}
+
+	return nil
 }
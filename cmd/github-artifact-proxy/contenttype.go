@@ -0,0 +1,73 @@
+package main
+
+import (
+	"fmt"
+	"mime"
+	"net/http"
+	"path"
+	"strings"
+)
+
+// defaultContentTypes maps the extensions of common CI artifacts that Go's
+// MIME detection doesn't know about to their content type. Files with one of
+// these extensions are served as downloads.
+var defaultContentTypes = map[string]string{
+	".apk":      "application/vnd.android.package-archive",
+	".aab":      "application/octet-stream",
+	".appimage": "application/vnd.appimage",
+	".deb":      "application/vnd.debian.binary-package",
+	".dmg":      "application/x-apple-diskimage",
+	".ipa":      "application/octet-stream",
+	".msi":      "application/x-msi",
+	".rpm":      "application/x-rpm",
+	".whl":      "application/zip",
+}
+
+// parseContentTypes merges the given extension to content type mapping with
+// the default one. Extensions are matched case-insensitively.
+func parseContentTypes(contentTypes map[string]string) (map[string]string, error) {
+	res := make(map[string]string, len(defaultContentTypes)+len(contentTypes))
+	for ext, contentType := range defaultContentTypes {
+		res[ext] = contentType
+	}
+
+	for ext, contentType := range contentTypes {
+		if !strings.HasPrefix(ext, ".") || len(ext) < 2 {
+			return nil, fmt.Errorf("invalid extension: '%s' (expected a leading dot)", ext)
+		}
+		if _, _, err := mime.ParseMediaType(contentType); err != nil {
+			return nil, fmt.Errorf("invalid content type for extension '%s': %w", ext, err)
+		}
+		res[strings.ToLower(ext)] = contentType
+	}
+
+	return res, nil
+}
+
+// getContentType returns the configured content type for the given filename,
+// if any.
+func (s *Server) getContentType(filename string) (string, bool) {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	contentType, ok := s.Config.contentTypes[strings.ToLower(path.Ext(filename))]
+	return contentType, ok
+}
+
+// writeContentTypeHeaders sets the Content-Type header of the response to the
+// configured content type for the given filename, and marks the response as a
+// download through the Content-Disposition header. Filenames without a
+// configured content type are left to the file server's MIME detection.
+func (s *Server) writeContentTypeHeaders(w http.ResponseWriter, filename string) {
+	if filename == "" || strings.HasSuffix(filename, "/") {
+		return
+	}
+
+	contentType, ok := s.getContentType(filename)
+	if !ok {
+		return
+	}
+
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": path.Base(filename)}))
+}
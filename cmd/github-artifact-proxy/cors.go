@@ -0,0 +1,122 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// defaultCORSMethods are the methods that are allowed for cross-origin
+// requests if none are configured.
+var defaultCORSMethods = []string{http.MethodGet, http.MethodHead}
+
+type CORS struct {
+	// AllowedOrigins are the origins that are allowed to make cross-origin
+	// requests. "*" allows any origin.
+	AllowedOrigins []string `yaml:"allowed_origins"`
+	AllowedMethods []string `yaml:"allowed_methods"`
+	// AllowedHeaders are the request headers that clients are allowed to send
+	// with cross-origin requests, in addition to the CORS-safelisted ones
+	AllowedHeaders []string `yaml:"allowed_headers"`
+}
+
+func (c *CORS) validate() error {
+	if len(c.AllowedOrigins) == 0 {
+		return fmt.Errorf("at least one allowed origin is required")
+	}
+	for _, origin := range c.AllowedOrigins {
+		if origin == "*" {
+			continue
+		}
+		u, err := url.Parse(origin)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" ||
+			u.Path != "" || u.RawQuery != "" || u.Fragment != "" || u.User != nil {
+			return fmt.Errorf("invalid origin: '%s' (expected a scheme and host, e.g. https://example.com)", origin)
+		}
+	}
+
+	if len(c.AllowedMethods) == 0 {
+		c.AllowedMethods = append([]string(nil), defaultCORSMethods...)
+	}
+	for i, method := range c.AllowedMethods {
+		if !headerNameRegex.MatchString(method) {
+			return fmt.Errorf("invalid method: '%s'", method)
+		}
+		c.AllowedMethods[i] = strings.ToUpper(method)
+	}
+
+	for _, name := range c.AllowedHeaders {
+		if !headerNameRegex.MatchString(name) {
+			return fmt.Errorf("invalid header name: '%s'", name)
+		}
+	}
+
+	return nil
+}
+
+// isOriginAllowed reports whether cross-origin requests from the given origin
+// are allowed.
+func (c *CORS) isOriginAllowed(origin string) bool {
+	for _, allowed := range c.AllowedOrigins {
+		if allowed == "*" || allowed == origin {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *CORS) allowsAnyOrigin() bool {
+	for _, allowed := range c.AllowedOrigins {
+		if allowed == "*" {
+			return true
+		}
+	}
+	return false
+}
+
+// handleCORS sets the CORS headers on the response if the request comes from
+// an allowed origin. Preflight requests are answered directly, in which case
+// true is returned and the request must not be handled any further.
+func (s *Server) handleCORS(w http.ResponseWriter, r *http.Request) bool {
+	cors := s.getCORS()
+	if cors == nil {
+		return false
+	}
+
+	header := w.Header()
+	if !cors.allowsAnyOrigin() {
+		header.Add("Vary", "Origin")
+	}
+
+	origin := r.Header.Get("Origin")
+	if origin == "" || !cors.isOriginAllowed(origin) {
+		return false
+	}
+
+	if cors.allowsAnyOrigin() {
+		header.Set("Access-Control-Allow-Origin", "*")
+	} else {
+		header.Set("Access-Control-Allow-Origin", origin)
+	}
+
+	if r.Method != http.MethodOptions || r.Header.Get("Access-Control-Request-Method") == "" {
+		return false
+	}
+
+	header.Add("Vary", "Access-Control-Request-Method")
+	header.Add("Vary", "Access-Control-Request-Headers")
+	header.Set("Access-Control-Allow-Methods", strings.Join(cors.AllowedMethods, ", "))
+	if len(cors.AllowedHeaders) > 0 {
+		header.Set("Access-Control-Allow-Headers", strings.Join(cors.AllowedHeaders, ", "))
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return true
+}
+
+func (s *Server) getCORS() *CORS {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	return s.Config.CORS
+}
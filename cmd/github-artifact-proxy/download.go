@@ -0,0 +1,542 @@
+package main
+
+import (
+	"archive/zip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"time"
+
+	"github.com/google/go-github/v60/github"
+	log "github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// errArtifactFileNotFound is returned by fetchArtifact if the requested file
+// doesn't exist in the artifact.
+var errArtifactFileNotFound = errors.New("file not found in artifact")
+
+// errDownloadStatus is returned if the download of an artifact ZIP file fails
+// with an unexpected status code.
+var errDownloadStatus = errors.New("unexpected status code for artifact download")
+
+// downloadURLCacheTTL is the duration for which the signed download URL of an
+// artifact is reused. GitHub's URLs expire after about a minute, so this leaves
+// some time to actually use them.
+const downloadURLCacheTTL = 30 * time.Second
+
+type cachedDownloadURL struct {
+	url       *url.URL
+	fetchTime time.Time
+}
+
+// activeDownload keeps track of the requests that wait for a download, so that
+// it can be canceled once none of them are interested in it anymore.
+type activeDownload struct {
+	ctx     context.Context
+	cancel  context.CancelFunc
+	waiters int
+}
+
+// fetchArtifact downloads and extracts the artifact with the given ID, unless
+// that already happened. If filename is not empty, only that file is extracted
+// in single file mode. Concurrent calls for the same artifact and file are
+// coalesced into a single download, which is canceled once the contexts of all
+// of those calls are done.
+func (s *Server) fetchArtifact(ctx context.Context, logCtx *log.Entry, targetID string, target *Target, client *github.Client, artifactID int64, filename string) error {
+	key := fmt.Sprintf("%s/%s", target.getArtifactKey(artifactID), filename)
+	return s.coalesceDownload(ctx, logCtx, key, func(dlCtx context.Context) error {
+		return s.downloadArtifact(dlCtx, logCtx, targetID, target, client, artifactID, filename)
+	})
+}
+
+// coalesceDownload calls download for the given key, unless a download with
+// the same key is already in progress, in which case it waits for that one
+// instead. The context passed to download is canceled once the contexts of all
+// callers waiting for it are done.
+func (s *Server) coalesceDownload(ctx context.Context, logCtx *log.Entry, key string, download func(dlCtx context.Context) error) error {
+	for {
+		dl := s.joinDownload(key)
+		resChan := s.downloads.DoChan(key, func() (interface{}, error) {
+			// The download outlives the request that started it, but it's
+			// still traced as part of it
+			dlCtx, span := startDetachedSpan(dl.ctx, ctx, "download", attribute.String("key", key))
+			err := download(dlCtx)
+			endSpan(span, err)
+			return nil, err
+		})
+
+		select {
+		case res := <-resChan:
+			s.leaveDownload(key, dl)
+			if res.Shared {
+				logCtx.Info("shared artifact download with a concurrent request")
+			}
+
+			// We may have joined a download right as it was being canceled
+			// because everyone else lost interest, so start a new one
+			if errors.Is(res.Err, context.Canceled) && ctx.Err() == nil {
+				logCtx.Info("joined an artifact download that was canceled, retrying")
+				continue
+			}
+			return res.Err
+		case <-ctx.Done():
+			s.leaveDownload(key, dl)
+			return ctx.Err()
+		}
+	}
+}
+
+// joinDownload registers the caller as a waiter for the download with the
+// given key and returns it.
+func (s *Server) joinDownload(key string) *activeDownload {
+	s.activeDownloadsMutex.Lock()
+	defer s.activeDownloadsMutex.Unlock()
+
+	if s.activeDownloads == nil {
+		s.activeDownloads = make(map[string]*activeDownload)
+	}
+
+	dl, ok := s.activeDownloads[key]
+	if !ok || dl.ctx.Err() != nil {
+		ctx, cancel := context.WithCancel(context.Background())
+		dl = &activeDownload{ctx: ctx, cancel: cancel}
+		s.activeDownloads[key] = dl
+	}
+	dl.waiters++
+	return dl
+}
+
+// leaveDownload unregisters the caller as a waiter for the given download and
+// cancels it if nobody else waits for it.
+func (s *Server) leaveDownload(key string, dl *activeDownload) {
+	s.activeDownloadsMutex.Lock()
+	defer s.activeDownloadsMutex.Unlock()
+
+	dl.waiters--
+	if dl.waiters == 0 {
+		dl.cancel()
+		if s.activeDownloads[key] == dl {
+			delete(s.activeDownloads, key)
+		}
+	}
+}
+
+// downloadArtifact downloads and extracts the artifact with the given ID while
+// holding the artifact lock. The download is aborted once the given context is
+// done. Nothing is downloaded if the artifact (or the
+// requested file of it) was extracted while waiting for the lock.
+func (s *Server) downloadArtifact(dlCtx context.Context, logCtx *log.Entry, targetID string, target *Target, client *github.Client, artifactID int64, filename string) error {
+	waitCtx, waitCancel := s.withDownloadTimeout(dlCtx)
+	defer waitCancel()
+
+	artifactKey := target.getArtifactKey(artifactID)
+	if err := s.artifactLocks.Lock(waitCtx, artifactKey); err != nil {
+		return fmt.Errorf("acquire artifact lock: %w", err)
+	}
+	defer s.artifactLocks.Unlock(artifactKey)
+
+	dlDir := s.getArtifactCacheDir(artifactKey)
+	if isArtifactComplete(dlDir) || (s.UnzipSingleFile && isArtifactFileExtracted(dlDir, filename)) {
+		return nil
+	}
+
+	if target.isProtected() {
+		// The artifact may have been deleted since the caller marked it as
+		// protected
+		if err := markArtifactProtected(dlDir); err != nil {
+			return fmt.Errorf("mark artifact as protected: %w", err)
+		}
+	}
+
+	releaseSlot, err := s.acquireDownloadSlot(waitCtx, logCtx)
+	if err != nil {
+		return err
+	}
+	defer releaseSlot()
+
+	// Waiting for the lock and a download slot doesn't count towards the
+	// download timeout
+	ctx, cancel := s.withDownloadTimeout(dlCtx)
+	defer cancel()
+
+	logCtx.Info("preparing artifact download")
+
+	dlStart := time.Now()
+	dlOutcome := outcomeError
+	defer func() {
+		artifactDownloadDuration.WithLabelValues(targetID, dlOutcome).Observe(time.Since(dlStart).Seconds())
+	}()
+
+	tempZipFile, err := os.CreateTemp(s.TempDir, fmt.Sprintf("gh-artifact-%d-*.zip", artifactID))
+	if err != nil {
+		return fmt.Errorf("create temporary file to download the artifact zip to: %w", err)
+	}
+	defer deleteFile(logCtx, tempZipFile.Name())
+	defer tempZipFile.Close()
+
+	logCtx.WithFields(log.Fields{
+		"temp_zip_filename": tempZipFile.Name(),
+	}).Info("downloading and extracting artifact zip")
+
+	var stored bool
+	var zipReader *zip.ReadCloser
+	err = s.retryTruncatedDownload(logCtx, target, artifactID, func(attempt int) error {
+		if attempt > 1 {
+			if err := resetFile(tempZipFile); err != nil {
+				return fmt.Errorf("reset temporary artifact zip file: %w", err)
+			}
+		}
+
+		// A truncated copy in the artifact store is replaced by the one that
+		// is downloaded from GitHub instead
+		stored = false
+		if s.Store != nil && attempt == 1 {
+			var err error
+			if stored, err = s.downloadStoredArtifactZip(ctx, logCtx, artifactKey, tempZipFile); err != nil {
+				return err
+			}
+		}
+		if !stored {
+			if err := s.downloadArtifactZip(ctx, logCtx, targetID, target, client, artifactID, tempZipFile); err != nil {
+				return err
+			}
+		}
+
+		var err error
+		if zipReader, err = zip.OpenReader(tempZipFile.Name()); err != nil {
+			return fmt.Errorf("open zip file: %w", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	defer zipReader.Close()
+
+	if s.Store != nil && !stored {
+		if err := s.Store.Put(ctx, artifactKey, tempZipFile); err != nil {
+			artifactStoreTotal.WithLabelValues(outcomeError).Inc()
+			logCtx.WithError(err).Error("unable to upload artifact zip to the artifact store")
+		} else {
+			logCtx.Info("uploaded artifact zip to the artifact store")
+		}
+	}
+
+	// Before extracting the ZIP file, check if the requested file actually
+	// exists. Skip this check if we've requested the root directory.
+	singleFile := false
+	if filename != "" {
+		info, err := statZipFile(zipReader, path.Clean(filename))
+		if err != nil {
+			if os.IsNotExist(err) {
+				return fmt.Errorf("%w: %s", errArtifactFileNotFound, filename)
+			}
+			return fmt.Errorf("open file inside zip: %w", err)
+		}
+		singleFile = s.UnzipSingleFile && !info.IsDir()
+	}
+
+	if singleFile {
+		if err := markArtifactPartial(dlDir); err != nil {
+			return fmt.Errorf("mark artifact as partially extracted: %w", err)
+		}
+		if err := os.MkdirAll(dlDir, os.ModePerm); err != nil {
+			return fmt.Errorf("create directory to unzip the artifact to: %w", err)
+		}
+
+		_, span := tracer.Start(ctx, "unzip", trace.WithAttributes(attribute.String("filename", filename)))
+		err := UnzipFile(zipReader, path.Clean(filename), dlDir, s.getUnzipLimits())
+		endSpan(span, err)
+		if err != nil {
+			return fmt.Errorf("unzip artifact file: %w", err)
+		}
+	} else {
+		// Extract the artifact next to its final location, so that it only
+		// becomes visible once it's complete
+		tempDir, err := createTempArtifactDir(dlDir)
+		if err != nil {
+			return fmt.Errorf("create directory to unzip the artifact to: %w", err)
+		}
+
+		logZipCollisions(logCtx, zipReader, tempDir)
+
+		_, span := tracer.Start(ctx, "unzip")
+		err = Unzip(zipReader, tempDir, s.getUnzipLimits())
+		endSpan(span, err)
+		if err != nil {
+			deleteTempDir(logCtx, tempDir)
+			return fmt.Errorf("unzip artifact: %w", err)
+		}
+
+		if err := replaceArtifactDir(tempDir, dlDir); err != nil {
+			deleteTempDir(logCtx, tempDir)
+			return fmt.Errorf("move extracted artifact into place: %w", err)
+		}
+	}
+
+	if s.cache != nil {
+		if err := s.cache.Add(artifactKey, dlDir); err != nil {
+			logCtx.WithError(err).Error("unable to add artifact to cache index")
+		}
+		s.cache.Evict(logCtx, &s.artifactLocks, &s.artifactServeLocks, artifactKey)
+	}
+
+	dlOutcome = outcomeSuccess
+	return nil
+}
+
+// logZipCollisions warns about files in the given ZIP file that end up at the
+// same path when they're extracted to the given directory. Only the last of
+// those is kept.
+func logZipCollisions(logCtx *log.Entry, r *zip.ReadCloser, dir string) {
+	duplicates, caseConflicts := findZipCollisions(r.File)
+	for _, name := range duplicates {
+		logCtx.WithField("zip_entry", name).Warn("zip file contains duplicate entries, only extracting the last one")
+	}
+	if len(caseConflicts) == 0 {
+		return
+	}
+
+	insensitive, err := isCaseInsensitiveDir(dir)
+	if err != nil {
+		logCtx.WithError(err).Warn("unable to check whether the file system is case-insensitive")
+		return
+	}
+	if insensitive {
+		for _, name := range caseConflicts {
+			logCtx.WithField("zip_entry", name).Warn("zip file contains entries that only differ in case, only extracting the last one on this case-insensitive file system")
+		}
+	}
+}
+
+// acquireDownloadSlot waits for a free download slot if the number of
+// concurrent downloads is limited. The returned function releases the slot.
+func (s *Server) acquireDownloadSlot(ctx context.Context, logCtx *log.Entry) (func(), error) {
+	if s.downloadSlots == nil {
+		return func() {}, nil
+	}
+
+	if !s.downloadSlots.TryAcquire(1) {
+		logCtx.WithField("max_downloads", s.MaxDownloads).Info("waiting for a free download slot")
+		if err := s.downloadSlots.Acquire(ctx, 1); err != nil {
+			return nil, fmt.Errorf("acquire download slot: %w", err)
+		}
+	}
+	return func() { s.downloadSlots.Release(1) }, nil
+}
+
+// downloadArtifactZip downloads the ZIP file of the artifact with the given ID
+// from GitHub to the given file.
+func (s *Server) downloadArtifactZip(ctx context.Context, logCtx *log.Entry, targetID string, target *Target, client *github.Client, artifactID int64, dst *os.File) error {
+	res, err := s.openArtifactZip(ctx, logCtx, targetID, target, client, artifactID)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	n, err := copyWithProgress(dst, res.Body, logCtx, targetID, artifactID, res.ContentLength)
+	artifactDownloadBytesTotal.WithLabelValues(targetID).Add(float64(n))
+	if err != nil {
+		return fmt.Errorf("download artifact zip: %w", err)
+	}
+
+	return nil
+}
+
+// openArtifactZip requests the ZIP file of the artifact with the given ID from
+// GitHub through its signed download URL. The URL may have expired by the time
+// it's used, which the storage backend answers with 403. In that case, a fresh
+// URL is obtained and the request is tried once more.
+func (s *Server) openArtifactZip(ctx context.Context, logCtx *log.Entry, targetID string, target *Target, client *github.Client, artifactID int64) (*http.Response, error) {
+	for attempt := 1; ; attempt++ {
+		dlURL, err := s.getArtifactDownloadURL(ctx, logCtx, targetID, target, client, artifactID)
+		if err != nil {
+			return nil, fmt.Errorf("obtain artifact download url: %w", err)
+		}
+
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, dlURL.String(), nil)
+		if err != nil {
+			return nil, fmt.Errorf("prepare artifact download http request: %w", err)
+		}
+
+		res, err := s.dlClient.Do(req)
+		if err != nil {
+			return nil, fmt.Errorf("download artifact zip: %w", err)
+		}
+		if res.StatusCode == http.StatusOK {
+			return res, nil
+		}
+		res.Body.Close()
+
+		s.forgetArtifactDownloadURL(target, artifactID)
+		if res.StatusCode == http.StatusForbidden && attempt == 1 {
+			logCtx.Warn("artifact download url was rejected, it may have expired, retrying with a fresh one")
+			continue
+		}
+		return nil, fmt.Errorf("%w: %d", errDownloadStatus, res.StatusCode)
+	}
+}
+
+// retryTruncatedDownload calls the given function to download and open the ZIP
+// file of the given artifact of the target, until it succeeds or
+// DownloadMaxAttempts is reached. Only attempts that fail because the ZIP file
+// turned out to be truncated or corrupt are retried, as happens if the
+// download URL expires halfway through the download. A fresh download URL is
+// obtained for every retry.
+func (s *Server) retryTruncatedDownload(logCtx *log.Entry, target *Target, artifactID int64, fn func(attempt int) error) error {
+	for attempt := 1; ; attempt++ {
+		err := fn(attempt)
+		if err == nil || attempt >= s.DownloadMaxAttempts || !isTruncatedZipError(err) {
+			return err
+		}
+
+		logCtx.WithError(err).WithFields(log.Fields{
+			"attempt":      attempt,
+			"max_attempts": s.DownloadMaxAttempts,
+		}).Warn("artifact zip is truncated or corrupt, downloading it again")
+		s.forgetArtifactDownloadURL(target, artifactID)
+	}
+}
+
+// isTruncatedZipError reports whether the given error indicates that a ZIP
+// file wasn't downloaded completely.
+func isTruncatedZipError(err error) bool {
+	return errors.Is(err, zip.ErrFormat) || errors.Is(err, io.ErrUnexpectedEOF)
+}
+
+// resetFile truncates the given file and moves back to its start, so that it
+// can be written to again from scratch.
+func resetFile(f *os.File) error {
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	return f.Truncate(0)
+}
+
+// downloadStoredArtifactZip downloads the ZIP file of the artifact with the
+// given key from the artifact store to the given file, and reports whether it
+// did. Failures of the artifact store are logged and reported as the artifact
+// not being stored, so that the caller falls back to downloading the artifact
+// from GitHub.
+func (s *Server) downloadStoredArtifactZip(ctx context.Context, logCtx *log.Entry, artifactKey string, dst *os.File) (bool, error) {
+	rc, err := s.Store.Get(ctx, artifactKey)
+	if err != nil {
+		if errors.Is(err, errArtifactNotStored) {
+			artifactStoreTotal.WithLabelValues(outcomeMiss).Inc()
+			return false, nil
+		}
+
+		artifactStoreTotal.WithLabelValues(outcomeError).Inc()
+		logCtx.WithError(err).Error("unable to obtain artifact zip from the artifact store")
+		return false, nil
+	}
+	defer rc.Close()
+
+	if _, err := io.Copy(dst, rc); err != nil {
+		artifactStoreTotal.WithLabelValues(outcomeError).Inc()
+		logCtx.WithError(err).Error("unable to download artifact zip from the artifact store")
+
+		// Start over with an empty file
+		if err := resetFile(dst); err != nil {
+			return false, fmt.Errorf("reset temporary artifact zip file: %w", err)
+		}
+		return false, nil
+	}
+
+	artifactStoreTotal.WithLabelValues(outcomeHit).Inc()
+	logCtx.Info("downloaded artifact zip from the artifact store")
+	return true, nil
+}
+
+// writeFetchError logs the given error returned by fetchArtifact and writes
+// the matching error response.
+func (s *Server) writeFetchError(w http.ResponseWriter, r *http.Request, logCtx *log.Entry, err error) {
+	switch {
+	case errors.Is(err, context.Canceled):
+		logCtx.WithError(err).Warn("request canceled while waiting for the artifact download")
+		httpError(w, r, http.StatusServiceUnavailable)
+	case errors.Is(err, errDownloadStatus):
+		logCtx.WithError(err).Error("unable to download artifact")
+		httpError(w, r, http.StatusBadGateway)
+	case errors.Is(err, errArtifactFileNotFound):
+		logCtx.WithError(err).Warn("requested file not found in artifact")
+		httpError(w, r, http.StatusNotFound)
+	case errors.Is(err, errMemoryCacheTooSmall), errors.Is(err, errMemoryCacheEvicted):
+		logCtx.WithError(err).WithField("memory_cache_size", s.MemoryCacheSize).Error("unable to keep artifact in memory")
+		httpError(w, r, http.StatusInternalServerError)
+	case errors.Is(err, ErrUnzipLimit):
+		limits := s.getUnzipLimits()
+		logCtx.WithError(err).WithFields(log.Fields{
+			"max_size":  limits.MaxSize,
+			"max_files": limits.MaxFiles,
+		}).Error("artifact exceeds the extraction limits, aborting")
+		httpError(w, r, http.StatusInternalServerError)
+	default:
+		writeGithubError(w, r, logCtx, nil, err, "unable to download artifact")
+	}
+}
+
+// getArtifactDownloadURL returns the signed download URL of the artifact with
+// the given ID. URLs are cached for a short while, so that concurrent and
+// successive downloads of the same artifact don't each need an API call.
+func (s *Server) getArtifactDownloadURL(ctx context.Context, logCtx *log.Entry, targetID string, target *Target, client *github.Client, artifactID int64) (*url.URL, error) {
+	key := target.getArtifactKey(artifactID)
+	s.downloadURLsMutex.Lock()
+	cached, ok := s.downloadURLs[key]
+	s.downloadURLsMutex.Unlock()
+	if ok && time.Since(cached.fetchTime) < downloadURLCacheTTL {
+		return cached.url, nil
+	}
+
+	var dlURL *url.URL
+	err := withRetry(ctx, logCtx, s.GithubMaxAttempts, func() (*github.Response, error) {
+		var ghRes *github.Response
+		var err error
+		dlURL, ghRes, err = client.Actions.DownloadArtifact(ctx, target.Owner, target.Repo, artifactID, 3)
+		observeAPICall(targetID, "download_artifact", err)
+		return ghRes, err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	s.downloadURLsMutex.Lock()
+	defer s.downloadURLsMutex.Unlock()
+
+	if s.downloadURLs == nil {
+		s.downloadURLs = make(map[string]*cachedDownloadURL)
+	}
+	for key, cached := range s.downloadURLs {
+		if time.Since(cached.fetchTime) >= downloadURLCacheTTL {
+			delete(s.downloadURLs, key)
+		}
+	}
+	s.downloadURLs[key] = &cachedDownloadURL{url: dlURL, fetchTime: time.Now()}
+
+	return dlURL, nil
+}
+
+// forgetArtifactDownloadURL removes the cached download URL of the given
+// artifact of the target, i.e. because it was rejected.
+func (s *Server) forgetArtifactDownloadURL(target *Target, artifactID int64) {
+	s.downloadURLsMutex.Lock()
+	defer s.downloadURLsMutex.Unlock()
+
+	delete(s.downloadURLs, target.getArtifactKey(artifactID))
+}
+
+// withDownloadTimeout derives a context from the given one that is canceled once
+// the artifact download timeout expires.
+func (s *Server) withDownloadTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	if s.DownloadTimeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, s.DownloadTimeout)
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+
+	"github.com/julienschmidt/httprouter"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// dynamicTargetPrefix is the prefix of the IDs of the targets that are
+	// created on the fly for the requests of the dynamic mode. Targets from
+	// the config file with a slash in their ID can't be requested, so the
+	// prefix doesn't collide with any of them.
+	dynamicTargetPrefix = "gh/"
+	// maxDynamicTargets is the maximum number of targets that are kept for
+	// the requests of the dynamic mode. Once there are more, they're all
+	// dropped, along with their cached workflow runs.
+	maxDynamicTargets = 1000
+)
+
+var (
+	githubOwnerRegex = regexp.MustCompile("^[A-Za-z0-9-]+$")
+	githubRepoRegex  = regexp.MustCompile("^[A-Za-z0-9._-]+$")
+)
+
+// Dynamic enables serving the artifacts of any workflow of the allowed
+// repositories through /gh/<owner>/<repo>/<workflow>/, without having to
+// configure a target for every workflow.
+type Dynamic struct {
+	Token   string  `yaml:"token"`
+	BaseURL *string `yaml:"base_url"`
+	// AllowedRepos are the repositories that can be accessed, as matched by
+	// matchRepoPatterns.
+	AllowedRepos stringList `yaml:"allowed_repos"`
+}
+
+func (d *Dynamic) validate(tokens map[string]*Token) error {
+	if d.Token == "" {
+		return fmt.Errorf("requires a token")
+	}
+	if _, ok := tokens[d.Token]; !ok {
+		return fmt.Errorf("token with id '%s' not found in tokens list", d.Token)
+	}
+	if d.BaseURL != nil {
+		u, err := url.Parse(*d.BaseURL)
+		if err != nil {
+			return fmt.Errorf("invalid base URL: %w", err)
+		}
+		if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("invalid base URL: '%s' (expected an absolute http(s) URL)", *d.BaseURL)
+		}
+	}
+	if len(d.AllowedRepos) == 0 {
+		return fmt.Errorf("requires at least one allowed repository")
+	}
+	if err := validateRepoPatterns(d.AllowedRepos); err != nil {
+		return fmt.Errorf("allowed_repos: %w", err)
+	}
+
+	return nil
+}
+
+// withDynamicTarget looks up the target for the owner, repository and workflow
+// in the path of the request, and passes it on to the given handler like a
+// configured target.
+func (s *Server) withDynamicTarget(h httprouter.Handle) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+		owner := params.ByName("owner")
+		repo := params.ByName("repo")
+		workflow := params.ByName("workflow")
+		logCtx := requestLogger(r.Context()).WithFields(log.Fields{
+			"addr":     r.RemoteAddr,
+			"path":     r.URL.Path,
+			"owner":    owner,
+			"repo":     repo,
+			"workflow": workflow,
+		})
+
+		targetID, ok := s.getDynamicTarget(logCtx, owner, repo, workflow)
+		if !ok {
+			httpError(w, r, http.StatusNotFound)
+			return
+		}
+
+		h(w, r, append(params, httprouter.Param{Key: "target", Value: targetID}))
+	}
+}
+
+// getDynamicTarget returns the ID of the target for the given workflow,
+// creating the target if necessary. False is returned if the dynamic mode is
+// disabled or the repository isn't allowed.
+func (s *Server) getDynamicTarget(logCtx *log.Entry, owner string, repo string, workflow string) (string, bool) {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	dynamic := s.Config.Dynamic
+	if dynamic == nil {
+		logCtx.Warn("dynamic mode not configured")
+		return "", false
+	}
+	if !githubOwnerRegex.MatchString(owner) || !githubRepoRegex.MatchString(repo) || !githubRepoRegex.MatchString(workflow) {
+		logCtx.Warn("invalid repository or workflow")
+		return "", false
+	}
+	// The global allowlist applies to the dynamic targets as well
+	if !matchRepoPatterns(dynamic.AllowedRepos, owner, repo) ||
+		(len(s.Config.AllowedRepos) > 0 && !matchRepoPatterns(s.Config.AllowedRepos, owner, repo)) {
+		logCtx.Warn("repository not allowed")
+		return "", false
+	}
+
+	// GitHub treats the owner and repository names case-insensitively
+	id := dynamicTargetPrefix + strings.ToLower(owner+"/"+repo) + "/" + workflow
+	if _, ok := s.dynamicTargets[id]; ok {
+		return id, true
+	}
+
+	if len(s.dynamicTargets) >= maxDynamicTargets {
+		logCtx.WithField("amount", len(s.dynamicTargets)).Info("too many dynamic targets, dropping them")
+		for _, target := range s.dynamicTargets {
+			delete(s.clients, target)
+		}
+		clear(s.dynamicTargets)
+	}
+
+	tokenID := dynamic.Token
+	s.dynamicTargets[id] = &Target{
+		Token:     &tokenID,
+		BaseURL:   dynamic.BaseURL,
+		Owner:     strings.ToLower(owner),
+		Repo:      strings.ToLower(repo),
+		Filenames: stringList{workflow},
+		runCache:  newRunCache(),
+		token:     s.Config.Tokens[tokenID],
+	}
+	return id, true
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	readinessCheckTimeout = 10 * time.Second
+)
+
+func (s *Server) handleLivenessRequest(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	fmt.Fprintln(w, "ok")
+}
+
+func (s *Server) handleReadinessRequest(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	logCtx := requestLogger(r.Context()).WithFields(log.Fields{
+		"addr": r.RemoteAddr,
+		"path": r.URL.Path,
+	})
+
+	if s.memCache == nil {
+		if err := checkDirWritable(s.DownloadDir); err != nil {
+			logCtx.WithError(err).Error("readiness check failed: download directory is not writable")
+			httpError(w, r, http.StatusServiceUnavailable)
+			return
+		}
+	}
+
+	if s.ReadinessCheckGithub {
+		ctx, cancel := context.WithTimeout(r.Context(), readinessCheckTimeout)
+		defer cancel()
+
+		for tokenID, target := range s.getTargetPerToken() {
+			client, err := s.getClient(target)
+			if err != nil {
+				logCtx.WithError(err).WithField("token", tokenID).Error("readiness check failed: unable to create github client")
+				httpError(w, r, http.StatusServiceUnavailable)
+				return
+			}
+
+			// Requests to the rate limit endpoint don't count against the rate limit
+			if _, _, err := client.RateLimit.Get(ctx); err != nil {
+				logCtx.WithError(err).WithField("token", tokenID).Error("readiness check failed: github api call failed")
+				httpError(w, r, http.StatusServiceUnavailable)
+				return
+			}
+		}
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	fmt.Fprintln(w, "ok")
+}
+
+// getTargetPerToken returns one target for each distinct token in use, so that
+// every token can be checked exactly once.
+func (s *Server) getTargetPerToken() map[string]*Target {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	targets := make(map[string]*Target)
+	for _, target := range s.Config.Targets {
+		if target.Token != nil {
+			targets[*target.Token] = target
+		}
+	}
+
+	return targets
+}
+
+func checkDirWritable(dir string) error {
+	file, err := os.CreateTemp(dir, ".readyz-*")
+	if err != nil {
+		return err
+	}
+
+	file.Close()
+	return os.Remove(file.Name())
+}
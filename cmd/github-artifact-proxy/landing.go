@@ -0,0 +1,89 @@
+package main
+
+import (
+	"bytes"
+	"html/template"
+	"net/http"
+
+	"github.com/julienschmidt/httprouter"
+	log "github.com/sirupsen/logrus"
+)
+
+var landingPageTemplate = template.Must(template.New("landing").Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<title>github-artifact-proxy</title>
+</head>
+<body>
+<h1>github-artifact-proxy</h1>
+<p>Files of GitHub Actions artifacts can be downloaded through the following URL paths:</p>
+<ul>
+<li><code>{{.BasePath}}/targets/&lt;target&gt;/runs/&lt;run_id&gt;/artifacts/&lt;artifact_name&gt;/&lt;file_name&gt;</code></li>
+<li><code>{{.BasePath}}/targets/&lt;target&gt;/artifacts/&lt;artifact_name&gt;/&lt;file_name&gt;</code> (latest workflow run)</li>
+</ul>
+<h2>Targets</h2>
+{{- if .Targets}}
+<table>
+<tr><th>Target</th><th>Repository</th><th>Workflow</th><th>Example</th></tr>
+{{- range .Targets}}
+<tr>
+<td>{{.Info.ID}}</td>
+<td>{{.Info.Owner}}/{{.Info.Repo}}</td>
+<td>{{if .Info.Filenames}}{{.Info.Filenames}}{{else if .Info.ArtifactID}}(artifact {{.Info.ArtifactID}}){{else}}(releases){{end}}</td>
+<td><code>{{.ExamplePath}}</code></td>
+</tr>
+{{- end}}
+</table>
+{{- else}}
+<p>No targets are configured.</p>
+{{- end}}
+</body>
+</html>
+`))
+
+type landingPageTarget struct {
+	Info        *targetInfo
+	ExamplePath string
+}
+
+// handleLandingPageRequest renders an HTML page at the base path that lists
+// the configured targets, to help with discovering the URL structure.
+func (s *Server) handleLandingPageRequest(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	logCtx := requestLogger(r.Context()).WithFields(log.Fields{
+		"addr": r.RemoteAddr,
+		"path": r.URL.Path,
+	})
+	logCtx.Debug("handling landing page request")
+
+	var targets []*landingPageTarget
+	for _, info := range s.getTargetInfos() {
+		examplePath := s.buildURLPath("/targets/"+info.ID+"/runs/latest/artifacts") + "/<artifact_name>/<file_name>"
+		if info.Type == targetTypeRelease {
+			examplePath = s.buildURLPath("/targets/"+info.ID+"/runs/latest/artifacts") + "/<asset_name>"
+		}
+		targets = append(targets, &landingPageTarget{
+			Info:        info,
+			ExamplePath: examplePath,
+		})
+	}
+
+	basePath := s.BasePath
+	if basePath == "/" {
+		basePath = ""
+	}
+
+	var buf bytes.Buffer
+	err := landingPageTemplate.Execute(&buf, map[string]interface{}{
+		"BasePath": basePath,
+		"Targets":  targets,
+	})
+	if err != nil {
+		logCtx.WithError(err).Error("unable to render landing page")
+		httpError(w, r, http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Write(buf.Bytes())
+}
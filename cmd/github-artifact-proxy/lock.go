@@ -0,0 +1,161 @@
+package main
+
+import (
+	"context"
+	"sync"
+)
+
+// keyedLock provides a separate lock for every key. Locks are created on
+// demand and dropped again once nobody holds or waits for them. The zero value
+// is ready to use.
+type keyedLock[K comparable] struct {
+	m     sync.Mutex
+	locks map[K]*keyedLockEntry
+}
+
+type keyedLockEntry struct {
+	ch chan struct{}
+	// refs is the number of goroutines that hold or wait for the lock
+	refs int
+}
+
+// Lock acquires the lock for the given key, or returns an error if the context
+// is done before that happens.
+func (l *keyedLock[K]) Lock(ctx context.Context, key K) error {
+	entry := l.ref(key)
+	select {
+	case entry.ch <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		l.unref(key, entry)
+		return ctx.Err()
+	}
+}
+
+// TryLock acquires the lock for the given key if that's possible without
+// waiting, and reports whether it did.
+func (l *keyedLock[K]) TryLock(key K) bool {
+	entry := l.ref(key)
+	select {
+	case entry.ch <- struct{}{}:
+		return true
+	default:
+		l.unref(key, entry)
+		return false
+	}
+}
+
+// Unlock releases the lock for the given key.
+func (l *keyedLock[K]) Unlock(key K) {
+	l.m.Lock()
+	entry := l.locks[key]
+	l.m.Unlock()
+
+	<-entry.ch
+	l.unref(key, entry)
+}
+
+func (l *keyedLock[K]) ref(key K) *keyedLockEntry {
+	l.m.Lock()
+	defer l.m.Unlock()
+
+	if l.locks == nil {
+		l.locks = make(map[K]*keyedLockEntry)
+	}
+
+	entry, ok := l.locks[key]
+	if !ok {
+		entry = &keyedLockEntry{ch: make(chan struct{}, 1)}
+		l.locks[key] = entry
+	}
+	entry.refs++
+	return entry
+}
+
+func (l *keyedLock[K]) unref(key K, entry *keyedLockEntry) {
+	l.m.Lock()
+	defer l.m.Unlock()
+
+	entry.refs--
+	if entry.refs == 0 {
+		delete(l.locks, key)
+	}
+}
+
+// keyedRWLock provides a separate reader/writer lock for every key. Locks are
+// created on demand and dropped again once nobody holds or waits for them. The
+// zero value is ready to use.
+type keyedRWLock[K comparable] struct {
+	m     sync.Mutex
+	locks map[K]*keyedRWLockEntry
+}
+
+type keyedRWLockEntry struct {
+	mu sync.RWMutex
+	// refs is the number of goroutines that hold or wait for the lock
+	refs int
+}
+
+// RLock acquires the lock for the given key for reading.
+func (l *keyedRWLock[K]) RLock(key K) {
+	l.ref(key).mu.RLock()
+}
+
+// RUnlock releases the read lock for the given key.
+func (l *keyedRWLock[K]) RUnlock(key K) {
+	entry := l.get(key)
+	entry.mu.RUnlock()
+	l.unref(key, entry)
+}
+
+// TryLock acquires the lock for the given key for writing if that's possible
+// without waiting, and reports whether it did.
+func (l *keyedRWLock[K]) TryLock(key K) bool {
+	entry := l.ref(key)
+	if !entry.mu.TryLock() {
+		l.unref(key, entry)
+		return false
+	}
+	return true
+}
+
+// Unlock releases the write lock for the given key.
+func (l *keyedRWLock[K]) Unlock(key K) {
+	entry := l.get(key)
+	entry.mu.Unlock()
+	l.unref(key, entry)
+}
+
+func (l *keyedRWLock[K]) get(key K) *keyedRWLockEntry {
+	l.m.Lock()
+	defer l.m.Unlock()
+
+	return l.locks[key]
+}
+
+func (l *keyedRWLock[K]) ref(key K) *keyedRWLockEntry {
+	l.m.Lock()
+	defer l.m.Unlock()
+
+	if l.locks == nil {
+		l.locks = make(map[K]*keyedRWLockEntry)
+	}
+
+	entry, ok := l.locks[key]
+	if !ok {
+		entry = &keyedRWLockEntry{}
+		l.locks[key] = entry
+	}
+	entry.refs++
+	return entry
+}
+
+func (l *keyedRWLock[K]) unref(key K, entry *keyedRWLockEntry) {
+	l.m.Lock()
+	defer l.m.Unlock()
+
+	entry.refs--
+	if entry.refs == 0 {
+		delete(l.locks, key)
+	}
+}
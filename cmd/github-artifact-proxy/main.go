@@ -1,53 +1,391 @@
 package main
 
 import (
+	"context"
 	"flag"
+	"fmt"
+	"net"
 	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
 	"time"
 
 	log "github.com/sirupsen/logrus"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
 )
 
 var (
-	downloadDir  string
-	httpAddr     string
-	httpBasePath string
-	configFile   string
-	ghCacheTTL   time.Duration
+	downloadDir        string
+	tempDir            string
+	httpAddr           string
+	httpBasePath       string
+	trustForwarded     bool
+	clientRateLimit    int
+	clientRateBurst    int
+	shutdownTimeout    time.Duration
+	readHeaderTimeout  time.Duration
+	readTimeout        time.Duration
+	writeTimeout       time.Duration
+	idleTimeout        time.Duration
+	enableH2C          bool
+	configFile         string
+	logFormat          string
+	logLevel           string
+	ghCacheTTL         time.Duration
+	ghMaxAttempts      int
+	ghTimeout          time.Duration
+	ghStaleRevalidate  bool
+	downloadTimeout    time.Duration
+	downloadAttempts   int
+	requestTimeout     time.Duration
+	maxDownloads       int
+	maxArtifactSize    ByteSize
+	metricsPath        string
+	healthzPath        string
+	readyzPath         string
+	healthSkipBasePath bool
+	readyzCheckGithub  bool
+	landingPage        bool
+	serveInline        bool
+	disableListings    bool
+	indexFile          string
+	inlineUserAgents   string
+	prefetch           bool
+	prefetchInterval   time.Duration
+	persistRuns        bool
+	artifactMaxAge     time.Duration
+	compress           bool
+	otlpEndpoint       string
+	tlsCert            string
+	tlsKey             string
+	acmeHosts          string
+	acmeEmail          string
+	acmeCacheDir       string
+	s3Endpoint         string
+	s3Region           string
+	s3Bucket           string
+	s3Prefix           string
+	cacheMaxSize       ByteSize
+	memoryCacheSize    ByteSize
+	unzipMaxSize       ByteSize
+	unzipMaxFiles      int
+	unzipSingleFile    bool
+	validate           bool
+	validateGithub     bool
+	printVersion       bool
 )
 
 func main() {
-	flag.StringVar(&downloadDir, "download-dir", "", "the directory to download artifacts to (required)")
+	flag.StringVar(&tempDir, "temp-dir", "", "the directory to download artifact ZIP files to before they're extracted (default \"<download-dir>/tmp\")")
+	flag.StringVar(&downloadDir, "download-dir", "", "the directory to download artifacts to (required, unless -memory-cache-size is set)")
+	flag.Var(&cacheMaxSize, "cache-max-size", "the maximum `size` of the artifact cache (e.g. 10GB), after which the least recently accessed artifacts are evicted (0 to disable)")
+	flag.Var(&memoryCacheSize, "memory-cache-size", "keep artifacts in memory instead of in the download directory, up to a total `size` (e.g. 512MB), for read-only file systems (0 to disable)")
 	flag.DurationVar(&ghCacheTTL, "github-api-cache-ttl", 5*time.Minute, "the duration after which cached GitHub API responses are invalidated")
-	flag.StringVar(&httpAddr, "http-addr", "", "the adddress the HTTP server should listen on (required)")
+	flag.IntVar(&ghMaxAttempts, "github-api-max-attempts", 3, "the maximum number of attempts for GitHub API calls that fail with a transient error")
+	flag.DurationVar(&ghTimeout, "github-api-timeout", 30*time.Second, "the timeout of GitHub API calls")
+	flag.BoolVar(&ghStaleRevalidate, "github-api-cache-stale-while-revalidate", false, "serve expired GitHub API responses from the cache while they're refreshed in the background, instead of waiting for the refresh")
+	flag.DurationVar(&downloadTimeout, "download-timeout", 10*time.Minute, "the timeout of artifact downloads from GitHub (0 for no limit)")
+	flag.IntVar(&downloadAttempts, "download-max-attempts", 3, "the maximum number of attempts to download an artifact ZIP file that turns out to be truncated or corrupt")
+	flag.DurationVar(&requestTimeout, "request-timeout", 0, "the maximum duration of the resolution and download of an artifact for a single request, after which it gets a 504 response (0 for no limit)")
+	flag.IntVar(&maxDownloads, "max-downloads", 0, "the maximum number of artifacts that are downloaded and extracted concurrently, additional requests wait for a free slot (0 for no limit)")
+	flag.Var(&maxArtifactSize, "max-artifact-size", "the maximum `size` of an artifact (e.g. 1GB) as reported by GitHub, larger artifacts aren't downloaded (0 for no limit)")
+	flag.BoolVar(&persistRuns, "persist-runs", false, "persist the cached workflow runs to the download directory, so that cached artifacts can be served after a restart without looking up their workflow runs again until they expire")
+	flag.StringVar(&httpAddr, "http-addr", "", "a comma-separated list of addresses the HTTP server should listen on, e.g. \"127.0.0.1:8080,[::1]:8080\" (required)")
 	flag.StringVar(&httpBasePath, "http-base-path", "/", "the base path prefixed to all URL paths")
-	flag.StringVar(&configFile, "config", "", "the filename of the configuration file (required)")
+	flag.BoolVar(&trustForwarded, "trust-forwarded-headers", false, "honor the X-Forwarded-Proto, X-Forwarded-Host and X-Forwarded-Prefix headers of a reverse proxy in redirects, and X-Forwarded-For for the client IP (only enable this if every request goes through such a proxy)")
+	flag.IntVar(&clientRateLimit, "client-rate-limit", 0, "the maximum number of requests per minute per client IP address, additional requests get a 429 response (0 for no limit)")
+	flag.IntVar(&clientRateBurst, "client-rate-limit-burst", 0, "the number of requests a client can make at once before -client-rate-limit kicks in (default the value of -client-rate-limit)")
+	flag.StringVar(&tlsCert, "tls-cert", "", "the filename of the TLS certificate to serve HTTPS with")
+	flag.StringVar(&tlsKey, "tls-key", "", "the filename of the private key of the TLS certificate")
+	flag.StringVar(&acmeHosts, "acme-hosts", "", "a comma-separated list of hostnames to obtain TLS certificates for from Let's Encrypt, instead of using -tls-cert and -tls-key")
+	flag.StringVar(&acmeEmail, "acme-email", "", "the contact email address for the Let's Encrypt account (optional)")
+	flag.StringVar(&acmeCacheDir, "acme-cache-dir", "", "the directory to store certificates obtained from Let's Encrypt in (default \"<download-dir>/acme\")")
+	flag.DurationVar(&readHeaderTimeout, "http-read-header-timeout", 10*time.Second, "the timeout for reading the headers of a request (0 for no limit)")
+	flag.DurationVar(&readTimeout, "http-read-timeout", 0, "the timeout for reading an entire request, including the body (0 for no limit)")
+	flag.DurationVar(&writeTimeout, "http-write-timeout", 0, "the timeout for writing a response, including the time it takes to download an artifact if necessary (0 for no limit)")
+	flag.DurationVar(&idleTimeout, "http-idle-timeout", 2*time.Minute, "the duration after which idle keep-alive connections are closed")
+	flag.BoolVar(&enableH2C, "h2c", false, "serve HTTP/2 without TLS (h2c) for reverse proxies that support it, HTTP/2 is always enabled with TLS")
+	flag.DurationVar(&shutdownTimeout, "shutdown-timeout", 30*time.Second, "the duration in-flight requests are given to finish on shutdown")
+	flag.StringVar(&configFile, "config", "", "the filename of the configuration file, or a comma-separated list of files and directories whose YAML files are merged in order (required)")
+	flag.Var(&unzipMaxSize, "unzip-max-size", "the maximum total uncompressed `size` of an artifact (e.g. 1GB) (0 for no limit)")
+	flag.IntVar(&unzipMaxFiles, "unzip-max-files", 0, "the maximum number of files in an artifact (0 for no limit)")
+	flag.BoolVar(&unzipSingleFile, "unzip-single-file", false, "only extract the requested file of an artifact, instead of the whole artifact (unless a directory is requested)")
+	flag.StringVar(&logFormat, "log-format", "text", "the log format (text or json)")
+	flag.StringVar(&logLevel, "log-level", "info", "the minimum level of log messages (trace, debug, info, warn, error)")
+	flag.StringVar(&metricsPath, "metrics-path", "", "the URL path to expose Prometheus metrics on (e.g. /metrics) (empty to disable)")
+	flag.StringVar(&healthzPath, "healthz-path", "/healthz", "the URL path of the liveness check (empty to disable)")
+	flag.StringVar(&readyzPath, "readyz-path", "/readyz", "the URL path of the readiness check (empty to disable)")
+	flag.BoolVar(&healthSkipBasePath, "health-skip-base-path", false, "don't prefix the liveness and readiness check paths with the base path")
+	flag.BoolVar(&readyzCheckGithub, "readyz-check-github", false, "verify that every configured token can access the GitHub API in the readiness check")
+	flag.BoolVar(&serveInline, "serve-inline", false, "serve the files of artifacts directly, instead of redirecting clients to them")
+	flag.BoolVar(&disableListings, "disable-listings", false, "don't serve listings of the files of artifacts, directories without an index file get a 404 response instead")
+	flag.StringVar(&indexFile, "index-file", "index.html", "the name of the file to serve for directories of artifacts that contain it, instead of a listing")
+	flag.StringVar(&inlineUserAgents, "inline-user-agents", "", "a comma-separated list of User-Agent prefixes (e.g. curl/,Wget/) of clients to serve the files of artifacts directly to, instead of redirecting them")
+	flag.DurationVar(&artifactMaxAge, "artifact-max-age", 0, "let clients and CDNs cache the files of artifacts for the given duration as immutable, instead of revalidating them on every request (0 to disable)")
+	flag.BoolVar(&prefetch, "prefetch", false, "download the artifacts of the latest workflow run of every target in the background on startup")
+	flag.DurationVar(&prefetchInterval, "prefetch-interval", 0, "prefetch the artifacts of the latest workflow runs again at this interval, implies -prefetch (0 to only do so on startup)")
+	flag.BoolVar(&landingPage, "landing-page", false, "serve an HTML page that lists the configured targets at the base path")
+	flag.StringVar(&s3Bucket, "s3-bucket", "", "the S3 bucket to share downloaded artifact ZIP files between replicas through (empty to disable)")
+	flag.StringVar(&s3Prefix, "s3-prefix", "", "the prefix of the object keys of artifact ZIP files in the S3 bucket")
+	flag.StringVar(&s3Region, "s3-region", "us-east-1", "the region of the S3 bucket")
+	flag.StringVar(&s3Endpoint, "s3-endpoint", "", "the URL of the S3 API (default \"https://s3.<region>.amazonaws.com\")")
+	flag.BoolVar(&validate, "validate", false, "validate the configuration file and exit, instead of starting the server")
+	flag.BoolVar(&validateGithub, "validate-github", false, "also check that the workflow of every target exists on GitHub when validating the configuration file")
+	flag.BoolVar(&printVersion, "version", false, "print the version and exit")
+	flag.StringVar(&otlpEndpoint, "otlp-endpoint", "", "the URL of the OTLP/HTTP endpoint to export traces to (e.g. http://localhost:4318), if not set through the OTEL_EXPORTER_OTLP_ENDPOINT environment variable (empty to disable tracing)")
+	flag.BoolVar(&compress, "compress", false, "compress text-based files and responses on the fly for clients that support gzip or brotli")
 	flag.Parse()
 
-	if downloadDir == "" {
-		log.Fatal("flag -download-dir is required")
+	if printVersion {
+		fmt.Println(getVersionInfo())
+		return
 	}
-	if httpAddr == "" {
-		log.Fatal("flag -http-addr is required")
+
+	switch logFormat {
+	case "text":
+		log.SetFormatter(&log.TextFormatter{})
+	case "json":
+		log.SetFormatter(&log.JSONFormatter{})
+	default:
+		log.Fatalf("unknown log format: %s", logFormat)
 	}
+
+	level, err := log.ParseLevel(logLevel)
+	if err != nil {
+		log.WithError(err).Fatal("unable to parse log level")
+	}
+	log.SetLevel(level)
+
 	if configFile == "" {
 		log.Fatal("flag -config is required")
 	}
+	if validate {
+		if err := validateConfig(configFile, validateGithub, ghTimeout); err != nil {
+			log.WithError(err).Fatal("config file is invalid")
+		}
+		log.Info("config file is valid")
+		return
+	}
+
+	if memoryCacheSize > 0 {
+		switch {
+		case downloadDir != "":
+			log.Fatal("flag -download-dir can't be combined with -memory-cache-size")
+		case cacheMaxSize > 0:
+			log.Fatal("flag -cache-max-size can't be combined with -memory-cache-size")
+		case s3Bucket != "":
+			log.Fatal("flag -s3-bucket can't be combined with -memory-cache-size")
+		case unzipSingleFile:
+			log.Fatal("flag -unzip-single-file can't be combined with -memory-cache-size")
+		case tempDir != "":
+			log.Fatal("flag -temp-dir can't be combined with -memory-cache-size")
+		case persistRuns:
+			log.Fatal("flag -persist-runs can't be combined with -memory-cache-size")
+		case acmeHosts != "" && acmeCacheDir == "":
+			log.Fatal("flag -acme-cache-dir is required with -acme-hosts and -memory-cache-size")
+		}
+	} else if downloadDir == "" {
+		log.Fatal("flag -download-dir is required")
+	}
+	httpAddrs := parseList(httpAddr)
+	if len(httpAddrs) == 0 {
+		log.Fatal("flag -http-addr is required")
+	}
+	if enableH2C && (tlsCert != "" || tlsKey != "" || acmeHosts != "") {
+		log.Fatal("flag -h2c can't be combined with TLS")
+	}
 
 	cfg, err := LoadConfig(configFile)
 	if err != nil {
 		log.WithError(err).Fatal("unable to read config file")
 	}
 
-	log.WithField("addr", httpAddr).Info("starting http server")
+	tlsCfg := TLSConfig{
+		CertFile:     tlsCert,
+		KeyFile:      tlsKey,
+		ACMEHosts:    parseList(acmeHosts),
+		ACMEEmail:    acmeEmail,
+		ACMECacheDir: acmeCacheDir,
+	}
+	if tlsCfg.ACMECacheDir == "" {
+		tlsCfg.ACMECacheDir = filepath.Join(downloadDir, "acme")
+	}
+
+	log.WithFields(log.Fields{
+		"addr":    httpAddrs,
+		"tls":     tlsCfg.Enabled(),
+		"version": getVersionInfo().Version,
+	}).Info("starting http server")
 
-	server := NewServer(&ServerConfig{
-		Config:         cfg,
-		BasePath:       httpBasePath,
-		DownloadDir:    downloadDir,
-		GithubCacheTTL: ghCacheTTL,
+	var store ArtifactStore
+	if s3Bucket != "" {
+		if store, err = NewS3Store(s3Endpoint, s3Region, s3Bucket, s3Prefix); err != nil {
+			log.WithError(err).Fatal("unable to configure s3 artifact store")
+		}
+	}
+
+	server, err := NewServer(&ServerConfig{
+		Config:               cfg,
+		BasePath:             httpBasePath,
+		TrustForwarded:       trustForwarded,
+		ClientRateLimit:      clientRateLimit,
+		ClientRateLimitBurst: clientRateBurst,
+		DownloadDir:          downloadDir,
+		TempDir:              tempDir,
+		GithubCacheTTL:       ghCacheTTL,
+		GithubMaxAttempts:    ghMaxAttempts,
+		GithubTimeout:        ghTimeout,
+		StaleWhileRevalidate: ghStaleRevalidate,
+		DownloadTimeout:      downloadTimeout,
+		DownloadMaxAttempts:  downloadAttempts,
+		RequestTimeout:       requestTimeout,
+		MaxDownloads:         maxDownloads,
+		MaxArtifactSize:      int64(maxArtifactSize),
+		MetricsPath:          metricsPath,
+		CacheMaxSize:         int64(cacheMaxSize),
+		MemoryCacheSize:      int64(memoryCacheSize),
+		UnzipLimits: UnzipLimits{
+			MaxSize:  int64(unzipMaxSize),
+			MaxFiles: unzipMaxFiles,
+		},
+		UnzipSingleFile: unzipSingleFile,
+		Store:           store,
+		Compress:        compress,
+		HealthPaths: HealthPaths{
+			Liveness:     healthzPath,
+			Readiness:    readyzPath,
+			SkipBasePath: healthSkipBasePath,
+		},
+		ReadinessCheckGithub: readyzCheckGithub,
+		LandingPage:          landingPage,
+		ServeInline:          serveInline,
+		DisableListings:      disableListings,
+		IndexFile:            indexFile,
+		InlineUserAgents:     parseList(inlineUserAgents),
+		ArtifactMaxAge:       artifactMaxAge,
+		PrefetchInterval:     prefetchInterval,
+		PersistRuns:          persistRuns,
 	})
-	if err := http.ListenAndServe(httpAddr, server); err != nil {
+	if err != nil {
+		log.WithError(err).Fatal("unable to create server")
+	}
+
+	shutdownTracing, err := setupTracing(context.Background(), otlpEndpoint)
+	if err != nil {
+		log.WithError(err).Fatal("unable to set up tracing")
+	}
+
+	go reloadConfigOnSignal(server)
+	if prefetch || prefetchInterval > 0 {
+		go server.prefetchLoop()
+	}
+	go server.refreshLoop()
+	if persistRuns {
+		go server.persistRunsLoop()
+	}
+
+	httpServer := &http.Server{
+		Handler:           server,
+		ReadHeaderTimeout: readHeaderTimeout,
+		ReadTimeout:       readTimeout,
+		WriteTimeout:      writeTimeout,
+		IdleTimeout:       idleTimeout,
+	}
+	if enableH2C {
+		httpServer.Handler = h2c.NewHandler(server, &http2.Server{})
+	}
+	if tlsCfg.Enabled() {
+		if httpServer.TLSConfig, err = tlsCfg.Build(); err != nil {
+			log.WithError(err).Fatal("unable to configure tls")
+		}
+	}
+
+	// All listeners are opened before serving any requests, so that an
+	// address that can't be bound to doesn't leave the server half running
+	listeners := make([]net.Listener, 0, len(httpAddrs))
+	for _, addr := range httpAddrs {
+		ln, err := net.Listen("tcp", addr)
+		if err != nil {
+			log.WithError(err).WithField("addr", addr).Fatal("unable to listen")
+		}
+		listeners = append(listeners, ln)
+	}
+
+	// Shutting down the server closes all of its listeners
+	errChan := make(chan error, len(listeners))
+	for _, ln := range listeners {
+		go func(ln net.Listener) {
+			if tlsCfg.Enabled() {
+				errChan <- httpServer.ServeTLS(ln, tlsCfg.CertFile, tlsCfg.KeyFile)
+			} else {
+				errChan <- httpServer.Serve(ln)
+			}
+		}(ln)
+	}
+
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
+
+	select {
+	case err := <-errChan:
 		log.WithError(err).Fatal("unable to start http server")
+	case sig := <-sigChan:
+		log.WithFields(log.Fields{
+			"signal":  sig,
+			"timeout": shutdownTimeout,
+		}).Info("shutting down http server")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := httpServer.Shutdown(ctx); err != nil {
+		log.WithError(err).Error("unable to gracefully shut down http server")
+		return
+	}
+	if persistRuns {
+		if err := server.SaveRuns(); err != nil {
+			log.WithError(err).Error("unable to persist cached workflow runs")
+		}
+	}
+	if err := shutdownTracing(ctx); err != nil {
+		log.WithError(err).Error("unable to flush traces")
+	}
+
+	log.Info("http server shut down")
+}
+
+// reloadConfigOnSignal reloads the configuration file every time the process
+// receives SIGHUP. The old configuration is kept if the new one is invalid.
+func reloadConfigOnSignal(server *Server) {
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, syscall.SIGHUP)
+
+	for range sigChan {
+		log.WithField("config", configFile).Info("reloading config file")
+
+		cfg, err := LoadConfig(configFile)
+		if err != nil {
+			log.WithError(err).Error("unable to reload config file, keeping the old config")
+			continue
+		}
+
+		server.ReloadConfig(cfg)
+		log.Info("reloaded config file")
+	}
+}
+
+// parseList splits a comma-separated list of values, like the hostnames passed
+// to -acme-hosts.
+func parseList(s string) []string {
+	var values []string
+	for _, value := range strings.Split(s, ",") {
+		if value = strings.TrimSpace(value); value != "" {
+			values = append(values, value)
+		}
 	}
+	return values
 }
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"archive/zip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/go-github/v60/github"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// zipManifestChunkSize is the size of the parts of an artifact ZIP file
+	// that are requested at once to read its central directory. The central
+	// directory is at the end of the ZIP file, so the first request for the
+	// last part of the file usually covers it entirely.
+	zipManifestChunkSize = 64 * 1024
+	// maxZipManifestReadSize is the maximum number of bytes of an artifact
+	// ZIP file that are read to build its manifest.
+	maxZipManifestReadSize = 32 * 1024 * 1024
+)
+
+// errRangeNotSupported is returned if the server that hosts an artifact ZIP
+// file doesn't answer range requests.
+var errRangeNotSupported = errors.New("range requests not supported")
+
+type zipEntryInfo struct {
+	Path           string    `json:"path"`
+	Size           uint64    `json:"size"`
+	CompressedSize uint64    `json:"compressed_size"`
+	Modified       time.Time `json:"modified"`
+}
+
+type zipManifest struct {
+	Size  int64           `json:"size"`
+	Files []*zipEntryInfo `json:"files"`
+}
+
+// serveZipManifest writes a JSON listing of the files in the ZIP file of the
+// given artifact, as found in its central directory. Only the central
+// directory is downloaded, through range requests, so nothing has to be
+// extracted.
+func (s *Server) serveZipManifest(w http.ResponseWriter, r *http.Request, logCtx *log.Entry, targetID string, target *Target, client *github.Client, artifactID int64) bool {
+	dlCtx, dlCancel := s.withDownloadTimeout(r.Context())
+	defer dlCancel()
+
+	manifest, err := s.readZipManifest(dlCtx, logCtx, targetID, target, client, artifactID)
+	if err != nil {
+		if errors.Is(err, errDownloadStatus) || errors.Is(err, errRangeNotSupported) || errors.Is(err, zip.ErrFormat) {
+			logCtx.WithError(err).Error("unable to read artifact zip manifest")
+			httpError(w, r, http.StatusBadGateway)
+			return false
+		}
+		writeGithubError(w, r, logCtx, nil, err, "unable to read artifact zip manifest")
+		return false
+	}
+
+	logCtx.WithField("amount", len(manifest.Files)).Info("serving artifact zip manifest")
+	writeCacheHeaders(w)
+	writeJSON(w, logCtx, http.StatusOK, manifest)
+	return true
+}
+
+// readZipManifest reads the central directory of the ZIP file of the given
+// artifact. If the download URL is rejected, it's retried once with a fresh
+// one, like openArtifactZip does.
+func (s *Server) readZipManifest(ctx context.Context, logCtx *log.Entry, targetID string, target *Target, client *github.Client, artifactID int64) (*zipManifest, error) {
+	for attempt := 1; ; attempt++ {
+		dlURL, err := s.getArtifactDownloadURL(ctx, logCtx, targetID, target, client, artifactID)
+		if err != nil {
+			return nil, fmt.Errorf("obtain artifact download url: %w", err)
+		}
+
+		reader, err := newHTTPRangeReader(ctx, s.dlClient, dlURL)
+		if err != nil {
+			s.forgetArtifactDownloadURL(target, artifactID)
+			if errors.Is(err, errDownloadStatus) && attempt == 1 {
+				logCtx.WithError(err).Warn("artifact download url was rejected, it may have expired, retrying with a fresh one")
+				continue
+			}
+			return nil, err
+		}
+
+		zipReader, err := zip.NewReader(reader, reader.size)
+		artifactDownloadBytesTotal.WithLabelValues(targetID).Add(float64(reader.read))
+		if err != nil {
+			return nil, fmt.Errorf("read artifact zip: %w", err)
+		}
+
+		manifest := zipManifest{
+			Size:  reader.size,
+			Files: []*zipEntryInfo{},
+		}
+		for _, f := range zipReader.File {
+			if f.FileInfo().IsDir() {
+				continue
+			}
+			manifest.Files = append(manifest.Files, &zipEntryInfo{
+				Path:           path.Clean(strings.TrimPrefix(f.Name, "/")),
+				Size:           f.UncompressedSize64,
+				CompressedSize: f.CompressedSize64,
+				Modified:       f.Modified,
+			})
+		}
+		return &manifest, nil
+	}
+}
+
+// httpRangeReader reads a remote file through HTTP range requests, so that
+// only the parts of it that are actually read are downloaded.
+type httpRangeReader struct {
+	ctx    context.Context
+	client *http.Client
+	url    *url.URL
+	size   int64
+	// read is the number of bytes that were downloaded so far
+	read int64
+	// parts are the parts of the file that were downloaded so far, by offset
+	parts map[int64][]byte
+}
+
+// newHTTPRangeReader returns a reader for the file at the given URL. The last
+// part of the file is downloaded straight away, to find out its size.
+func newHTTPRangeReader(ctx context.Context, client *http.Client, u *url.URL) (*httpRangeReader, error) {
+	r := httpRangeReader{
+		ctx:    ctx,
+		client: client,
+		url:    u,
+		parts:  make(map[int64][]byte),
+	}
+	if err := r.fetch(fmt.Sprintf("bytes=-%d", zipManifestChunkSize)); err != nil {
+		return nil, err
+	}
+	return &r, nil
+}
+
+func (r *httpRangeReader) ReadAt(p []byte, off int64) (int, error) {
+	n := 0
+	for n < len(p) {
+		pos := off + int64(n)
+		if pos >= r.size {
+			return n, io.EOF
+		}
+
+		data, ok := r.getPart(pos)
+		if !ok {
+			if r.read >= maxZipManifestReadSize {
+				return n, fmt.Errorf("read more than %d bytes of the file", maxZipManifestReadSize)
+			}
+			if err := r.fetch(fmt.Sprintf("bytes=%d-%d", pos, min(pos+zipManifestChunkSize, r.size)-1)); err != nil {
+				return n, err
+			}
+			if data, ok = r.getPart(pos); !ok {
+				return n, fmt.Errorf("range starting at %d not returned by the server", pos)
+			}
+		}
+		n += copy(p[n:], data)
+	}
+	return n, nil
+}
+
+// getPart returns the downloaded data of the file starting at the given
+// offset, up until the end of the part it's in.
+func (r *httpRangeReader) getPart(off int64) ([]byte, bool) {
+	for start, data := range r.parts {
+		if off >= start && off < start+int64(len(data)) {
+			return data[off-start:], true
+		}
+	}
+	return nil, false
+}
+
+// fetch downloads the given range of the file.
+func (r *httpRangeReader) fetch(byteRange string) error {
+	req, err := http.NewRequestWithContext(r.ctx, http.MethodGet, r.url.String(), nil)
+	if err != nil {
+		return fmt.Errorf("prepare artifact download http request: %w", err)
+	}
+	req.Header.Set("Range", byteRange)
+
+	res, err := r.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("download artifact zip: %w", err)
+	}
+	defer res.Body.Close()
+
+	switch res.StatusCode {
+	case http.StatusPartialContent:
+	case http.StatusOK:
+		return errRangeNotSupported
+	default:
+		return fmt.Errorf("%w: %d", errDownloadStatus, res.StatusCode)
+	}
+
+	start, size, err := parseContentRange(res.Header.Get("Content-Range"))
+	if err != nil {
+		return err
+	}
+
+	data, err := io.ReadAll(io.LimitReader(res.Body, zipManifestChunkSize+1))
+	if err != nil {
+		return fmt.Errorf("download artifact zip: %w", err)
+	}
+	if len(data) > zipManifestChunkSize {
+		return fmt.Errorf("server returned more than the requested range")
+	}
+
+	r.size = size
+	r.read += int64(len(data))
+	r.parts[start] = data
+	return nil
+}
+
+// parseContentRange returns the start of the range and the total size of the
+// file from a Content-Range header like "bytes 100-199/1000".
+func parseContentRange(header string) (int64, int64, error) {
+	byteRange, sizeStr, ok := strings.Cut(strings.TrimPrefix(header, "bytes "), "/")
+	startStr, _, hasEnd := strings.Cut(byteRange, "-")
+	if !ok || !hasEnd {
+		return 0, 0, fmt.Errorf("invalid content range: %q", header)
+	}
+
+	start, err := strconv.ParseInt(startStr, 10, 64)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid content range: %q", header)
+	}
+	size, err := strconv.ParseInt(sizeStr, 10, 64)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid content range: %q", header)
+	}
+	return start, size, nil
+}
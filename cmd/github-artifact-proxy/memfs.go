@@ -0,0 +1,147 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"io/fs"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+// memArtifact is an extracted artifact that is kept in memory. It implements
+// fs.FS, so that it can be served and listed like an artifact directory on
+// disk.
+type memArtifact struct {
+	files map[string]*memFileInfo
+	size  int64
+}
+
+// memFileInfo describes a file or directory of a memArtifact. It implements
+// both fs.FileInfo and fs.DirEntry.
+type memFileInfo struct {
+	name    string
+	data    []byte
+	mode    fs.FileMode
+	modTime time.Time
+}
+
+func newMemArtifact() *memArtifact {
+	return &memArtifact{files: make(map[string]*memFileInfo)}
+}
+
+// add adds a file with the given slash-separated path to the artifact,
+// replacing any earlier file with the same path.
+func (a *memArtifact) add(name string, data []byte, mode fs.FileMode, modTime time.Time) {
+	if file, ok := a.files[name]; ok {
+		a.size -= int64(len(file.data))
+	}
+	a.files[name] = &memFileInfo{
+		name:    path.Base(name),
+		data:    data,
+		mode:    mode.Perm(),
+		modTime: modTime,
+	}
+	a.size += int64(len(data))
+}
+
+func (a *memArtifact) Open(name string) (fs.File, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrInvalid}
+	}
+
+	if file, ok := a.files[name]; ok {
+		return &memFile{info: file, Reader: bytes.NewReader(file.data)}, nil
+	}
+
+	// Directories only exist implicitly, through the files in them
+	entries := a.readDir(name)
+	if entries == nil {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+	}
+	return &memDir{
+		info:    &memFileInfo{name: path.Base(name), mode: fs.ModeDir | 0o555},
+		entries: entries,
+	}, nil
+}
+
+// readDir returns the sorted entries of the directory with the given name, or
+// nil if there's no such directory.
+func (a *memArtifact) readDir(name string) []fs.DirEntry {
+	prefix := ""
+	if name != "." {
+		prefix = name + "/"
+	}
+
+	dirs := make(map[string]bool)
+	var entries []fs.DirEntry
+	for filename, file := range a.files {
+		rest, ok := strings.CutPrefix(filename, prefix)
+		if !ok {
+			continue
+		}
+
+		if dir, _, ok := strings.Cut(rest, "/"); ok {
+			if !dirs[dir] {
+				dirs[dir] = true
+				entries = append(entries, &memFileInfo{name: dir, mode: fs.ModeDir | 0o555})
+			}
+			continue
+		}
+		entries = append(entries, file)
+	}
+
+	if entries == nil && name == "." {
+		return []fs.DirEntry{}
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Name() < entries[j].Name()
+	})
+	return entries
+}
+
+func (i *memFileInfo) Name() string               { return i.name }
+func (i *memFileInfo) Size() int64                { return int64(len(i.data)) }
+func (i *memFileInfo) Mode() fs.FileMode          { return i.mode }
+func (i *memFileInfo) ModTime() time.Time         { return i.modTime }
+func (i *memFileInfo) IsDir() bool                { return i.mode.IsDir() }
+func (i *memFileInfo) Sys() interface{}           { return nil }
+func (i *memFileInfo) Type() fs.FileMode          { return i.mode.Type() }
+func (i *memFileInfo) Info() (fs.FileInfo, error) { return i, nil }
+
+// memFile is an open file of a memArtifact. It's seekable, so that range
+// requests can be served from it.
+type memFile struct {
+	*bytes.Reader
+	info *memFileInfo
+}
+
+func (f *memFile) Stat() (fs.FileInfo, error) { return f.info, nil }
+func (f *memFile) Close() error               { return nil }
+
+// memDir is an open directory of a memArtifact.
+type memDir struct {
+	info    *memFileInfo
+	entries []fs.DirEntry
+	offset  int
+}
+
+func (d *memDir) Stat() (fs.FileInfo, error) { return d.info, nil }
+func (d *memDir) Close() error               { return nil }
+
+func (d *memDir) Read([]byte) (int, error) {
+	return 0, &fs.PathError{Op: "read", Path: d.info.name, Err: fs.ErrInvalid}
+}
+
+func (d *memDir) ReadDir(n int) ([]fs.DirEntry, error) {
+	entries := d.entries[d.offset:]
+	if n > 0 {
+		if len(entries) == 0 {
+			return nil, io.EOF
+		}
+		entries = entries[:min(n, len(entries))]
+	}
+	d.offset += len(entries)
+	return entries, nil
+}
@@ -0,0 +1,382 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/google/go-github/v60/github"
+	log "github.com/sirupsen/logrus"
+)
+
+// errMemoryCacheTooSmall is returned if an artifact doesn't fit in the memory
+// cache, even after evicting everything else.
+var errMemoryCacheTooSmall = errors.New("artifact exceeds the size of the memory cache")
+
+// errMemoryCacheEvicted is returned if an artifact was evicted from the memory
+// cache right after it was downloaded, before it could be served.
+var errMemoryCacheEvicted = errors.New("artifact was evicted from the memory cache")
+
+// memCache keeps extracted artifacts and release assets in memory, for
+// deployments without a writable file system. The least recently accessed
+// entries are evicted once the cache grows beyond its maximum size.
+type memCache struct {
+	m       sync.Mutex
+	maxSize int64
+	size    int64
+	entries map[string]*memCacheEntry
+}
+
+type memCacheEntry struct {
+	artifact   *memArtifact
+	lastAccess time.Time
+}
+
+func newMemCache(maxSize int64) *memCache {
+	return &memCache{
+		maxSize: maxSize,
+		entries: make(map[string]*memCacheEntry),
+	}
+}
+
+// Get returns the cached artifact with the given key and marks it as recently
+// accessed.
+func (c *memCache) Get(key string) (*memArtifact, bool) {
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	entry, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	entry.lastAccess = time.Now()
+	return entry.artifact, true
+}
+
+// Add adds the given artifact to the cache, evicting the least recently
+// accessed entries to make room for it.
+func (c *memCache) Add(logCtx *log.Entry, key string, artifact *memArtifact) error {
+	if artifact.size > c.maxSize {
+		return fmt.Errorf("%w: %d bytes", errMemoryCacheTooSmall, artifact.size)
+	}
+
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	c.remove(key)
+
+	keys := make([]string, 0, len(c.entries))
+	for key := range c.entries {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return c.entries[keys[i]].lastAccess.Before(c.entries[keys[j]].lastAccess)
+	})
+
+	for _, evictKey := range keys {
+		if c.size+artifact.size <= c.maxSize {
+			break
+		}
+
+		entry := c.entries[evictKey]
+		logCtx.WithFields(log.Fields{
+			"key":         evictKey,
+			"size":        entry.artifact.size,
+			"last_access": entry.lastAccess,
+		}).Info("evicting artifact from memory cache")
+		c.remove(evictKey)
+	}
+
+	c.entries[key] = &memCacheEntry{
+		artifact:   artifact,
+		lastAccess: time.Now(),
+	}
+	c.size += artifact.size
+	return nil
+}
+
+// Remove drops the artifact with the given key from the cache.
+func (c *memCache) Remove(key string) {
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	c.remove(key)
+}
+
+func (c *memCache) remove(key string) {
+	if entry, ok := c.entries[key]; ok {
+		c.size -= entry.artifact.size
+		delete(c.entries, key)
+	}
+}
+
+func getMemArtifactKey(artifactKey string) string {
+	return "artifact/" + artifactKey
+}
+
+func getMemReleaseAssetKey(assetKey string) string {
+	return "release/" + assetKey
+}
+
+// serveMemoryArtifact serves the requested file of the given artifact from the
+// memory cache, after downloading the artifact into it if necessary. If single
+// is set, the only file in the artifact is served instead. The outcome of the
+// request is returned for the metrics.
+func (s *Server) serveMemoryArtifact(w http.ResponseWriter, r *http.Request, logCtx *log.Entry, targetID string, target *Target, client *github.Client, artifact *github.Artifact, filename string, single bool) string {
+	key := getMemArtifactKey(target.getArtifactKey(artifact.GetID()))
+	outcome := outcomeHit
+
+	mem, ok := s.memCache.Get(key)
+	if ok {
+		logCtx.Info("serving artifact from memory cache")
+	} else {
+		// GitHub no longer allows downloading expired artifacts
+		if artifact.GetExpired() {
+			writeArtifactExpired(w, r, logCtx, artifact)
+			return outcomeError
+		}
+
+		if mem, ok = s.fetchMemoryEntry(w, r, logCtx, key, func(dlCtx context.Context) error {
+			return s.downloadArtifactToMemory(dlCtx, logCtx, targetID, target, client, artifact.GetID())
+		}); !ok {
+			return outcomeError
+		}
+
+		logCtx.Info("serving downloaded artifact from memory cache")
+		outcome = outcomeMiss
+		writeCacheHeaders(w)
+	}
+
+	var fsys fs.FS = mem
+	if target.StripPrefix != "" {
+		if info, err := fs.Stat(mem, target.StripPrefix); err != nil || !info.IsDir() {
+			logCtx.WithField("strip_prefix", target.StripPrefix).Warn("prefix to strip not found in artifact")
+			httpError(w, r, http.StatusNotFound)
+			return outcomeError
+		}
+		sub, err := fs.Sub(mem, target.StripPrefix)
+		if err != nil {
+			logCtx.WithError(err).Error("unable to strip prefix of artifact")
+			httpError(w, r, http.StatusInternalServerError)
+			return outcomeError
+		}
+		fsys = sub
+	}
+
+	if single {
+		if filename, ok = findSingleFile(w, r, logCtx, fsys); !ok {
+			return outcomeError
+		}
+		logCtx = logCtx.WithField("single_file", filename)
+	}
+
+	if requestsChecksum(r) {
+		s.serveChecksum(w, r, logCtx, target, artifact.GetID(), fsys, filename)
+		return outcome
+	}
+
+	if filename == "" {
+		w.Header().Add("Vary", "Accept")
+		if requestsJSON(r) {
+			s.serveArtifactListing(w, r, logCtx, fsys)
+			return outcome
+		}
+	}
+
+	if fallback, ok := target.resolveFallbackFile(fsys, filename); ok {
+		s.serveFallbackFile(w, r, logCtx, artifact.GetID(), http.FS(fsys), fallback)
+		return outcome
+	}
+
+	s.serveArtifactInline(w, r, logCtx, artifact.GetID(), http.FS(fsys), filename)
+	return outcome
+}
+
+// serveMemoryReleaseAsset serves the given release asset from the memory cache,
+// after downloading it into it if necessary. The outcome of the request is
+// returned for the metrics.
+func (s *Server) serveMemoryReleaseAsset(w http.ResponseWriter, r *http.Request, logCtx *log.Entry, targetID string, target *Target, client *github.Client, asset *github.Artifact) string {
+	key := getMemReleaseAssetKey(target.getArtifactKey(asset.GetID()))
+	outcome := outcomeHit
+
+	mem, ok := s.memCache.Get(key)
+	if ok {
+		logCtx.Info("serving release asset from memory cache")
+	} else {
+		if mem, ok = s.fetchMemoryEntry(w, r, logCtx, key, func(dlCtx context.Context) error {
+			return s.downloadReleaseAssetToMemory(dlCtx, logCtx, targetID, target, client, asset)
+		}); !ok {
+			return outcomeError
+		}
+
+		logCtx.Info("serving downloaded release asset from memory cache")
+		outcome = outcomeMiss
+		writeCacheHeaders(w)
+	}
+
+	s.serveArtifactInline(w, r, logCtx, asset.GetID(), http.FS(mem), asset.GetName())
+	return outcome
+}
+
+// fetchMemoryEntry calls download to add the entry with the given key to the
+// memory cache, coalescing concurrent calls for the same key, and returns it.
+// If that fails, an error response is written and false is returned.
+func (s *Server) fetchMemoryEntry(w http.ResponseWriter, r *http.Request, logCtx *log.Entry, key string, download func(dlCtx context.Context) error) (*memArtifact, bool) {
+	err := s.coalesceDownload(r.Context(), logCtx, "memory/"+key, download)
+	if err == nil {
+		mem, ok := s.memCache.Get(key)
+		if ok {
+			return mem, true
+		}
+		err = errMemoryCacheEvicted
+	}
+
+	s.writeFetchError(w, r, logCtx, err)
+	return nil, false
+}
+
+// downloadArtifactToMemory downloads the artifact with the given ID, extracts
+// it in memory and adds it to the memory cache. The download is aborted once
+// the given context is done.
+func (s *Server) downloadArtifactToMemory(dlCtx context.Context, logCtx *log.Entry, targetID string, target *Target, client *github.Client, artifactID int64) error {
+	waitCtx, waitCancel := s.withDownloadTimeout(dlCtx)
+	defer waitCancel()
+
+	releaseSlot, err := s.acquireDownloadSlot(waitCtx, logCtx)
+	if err != nil {
+		return err
+	}
+	defer releaseSlot()
+
+	// Waiting for a download slot doesn't count towards the download timeout
+	ctx, cancel := s.withDownloadTimeout(dlCtx)
+	defer cancel()
+
+	logCtx.Info("downloading and extracting artifact zip into memory")
+
+	dlStart := time.Now()
+	dlOutcome := outcomeError
+	defer func() {
+		artifactDownloadDuration.WithLabelValues(targetID, dlOutcome).Observe(time.Since(dlStart).Seconds())
+	}()
+
+	var mem *memArtifact
+	err = s.retryTruncatedDownload(logCtx, target, artifactID, func(attempt int) error {
+		var err error
+		mem, err = s.downloadArtifactZipToMemory(ctx, logCtx, targetID, target, client, artifactID)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	if err := s.memCache.Add(logCtx, getMemArtifactKey(target.getArtifactKey(artifactID)), mem); err != nil {
+		return err
+	}
+
+	dlOutcome = outcomeSuccess
+	return nil
+}
+
+// downloadArtifactZipToMemory downloads the ZIP file of the artifact with the
+// given ID from GitHub and extracts it in memory.
+func (s *Server) downloadArtifactZipToMemory(ctx context.Context, logCtx *log.Entry, targetID string, target *Target, client *github.Client, artifactID int64) (*memArtifact, error) {
+	res, err := s.openArtifactZip(ctx, logCtx, targetID, target, client, artifactID)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	// The ZIP file itself has to fit in the cache as well while it's being
+	// extracted
+	var buf bytes.Buffer
+	n, err := copyWithProgress(&buf, io.LimitReader(res.Body, s.MemoryCacheSize+1), logCtx, targetID, artifactID, res.ContentLength)
+	artifactDownloadBytesTotal.WithLabelValues(targetID).Add(float64(n))
+	if err != nil {
+		return nil, fmt.Errorf("download artifact zip: %w", err)
+	}
+	if n > s.MemoryCacheSize {
+		return nil, fmt.Errorf("%w: the zip file is larger than %d bytes", errMemoryCacheTooSmall, s.MemoryCacheSize)
+	}
+
+	// The ZIP file is kept in memory until it's fully extracted, so the
+	// extracted files may only take up the rest of the cache size
+	limits := s.getUnzipLimits()
+	if remaining := s.MemoryCacheSize - n; remaining <= 0 {
+		return nil, fmt.Errorf("%w: the zip file takes up the whole cache", errMemoryCacheTooSmall)
+	} else if limits.MaxSize > remaining {
+		limits.MaxSize = remaining
+	}
+
+	_, span := tracer.Start(ctx, "unzip")
+	mem, err := UnzipToMemory(buf.Bytes(), limits)
+	endSpan(span, err)
+	if err != nil {
+		return nil, fmt.Errorf("unzip artifact: %w", err)
+	}
+	return mem, nil
+}
+
+// getUnzipLimits returns the limits for extracting artifacts. In memory, never
+// more than fits in the cache is extracted, so that a ZIP bomb can't exhaust
+// the memory of the server.
+func (s *Server) getUnzipLimits() UnzipLimits {
+	limits := s.UnzipLimits
+	if s.memCache != nil && (limits.MaxSize <= 0 || limits.MaxSize > s.MemoryCacheSize) {
+		limits.MaxSize = s.MemoryCacheSize
+	}
+	return limits
+}
+
+// downloadReleaseAssetToMemory downloads the given release asset and adds it to
+// the memory cache. The download is aborted once the given context is done.
+func (s *Server) downloadReleaseAssetToMemory(dlCtx context.Context, logCtx *log.Entry, targetID string, target *Target, client *github.Client, asset *github.Artifact) error {
+	name := asset.GetName()
+	if err := checkReleaseAssetName(name); err != nil {
+		return err
+	}
+	if asset.GetSizeInBytes() > s.MemoryCacheSize {
+		return fmt.Errorf("%w: %d bytes", errMemoryCacheTooSmall, asset.GetSizeInBytes())
+	}
+
+	waitCtx, waitCancel := s.withDownloadTimeout(dlCtx)
+	defer waitCancel()
+
+	releaseSlot, err := s.acquireDownloadSlot(waitCtx, logCtx)
+	if err != nil {
+		return err
+	}
+	defer releaseSlot()
+
+	// Waiting for a download slot doesn't count towards the download timeout
+	ctx, cancel := s.withDownloadTimeout(dlCtx)
+	defer cancel()
+
+	logCtx.Info("downloading release asset into memory")
+
+	dlStart := time.Now()
+	dlOutcome := outcomeError
+	defer func() {
+		artifactDownloadDuration.WithLabelValues(targetID, dlOutcome).Observe(time.Since(dlStart).Seconds())
+	}()
+
+	var buf bytes.Buffer
+	if err := s.downloadReleaseAssetFile(ctx, logCtx, targetID, target, client, asset.GetID(), &buf); err != nil {
+		return err
+	}
+
+	mem := newMemArtifact()
+	mem.add(name, buf.Bytes(), 0o644, asset.GetUpdatedAt().Time)
+	if err := s.memCache.Add(logCtx, getMemReleaseAssetKey(target.getArtifactKey(asset.GetID())), mem); err != nil {
+		return err
+	}
+
+	dlOutcome = outcomeSuccess
+	return nil
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const (
+	metricsNamespace = "github_artifact_proxy"
+
+	outcomeHit     = "hit"
+	outcomeMiss    = "miss"
+	outcomeError   = "error"
+	outcomeSuccess = "success"
+	outcomeStale   = "stale"
+)
+
+var (
+	requestsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "requests_total",
+		Help:      "The total number of artifact requests, by target and outcome (hit/miss/error).",
+	}, []string{"target", "outcome"})
+
+	runCacheTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "run_cache_total",
+		Help:      "The total number of workflow run cache lookups, by target and outcome (hit/miss/stale).",
+	}, []string{"target", "outcome"})
+
+	githubAPICallsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "github_api_calls_total",
+		Help:      "The total number of GitHub API calls, by target, call and outcome (success/error).",
+	}, []string{"target", "call", "outcome"})
+
+	artifactDownloadBytesTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "artifact_download_bytes_total",
+		Help:      "The total number of artifact bytes downloaded from GitHub, by target.",
+	}, []string{"target"})
+
+	githubRateLimitRemaining = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "github_rate_limit_remaining",
+		Help:      "The last known remaining GitHub API rate limit, by token.",
+	}, []string{"token"})
+
+	artifactStoreTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "artifact_store_total",
+		Help:      "The total number of artifact store operations, by outcome (hit/miss/error).",
+	}, []string{"outcome"})
+
+	clientRateLimitedTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "client_rate_limited_total",
+		Help:      "The total number of requests that were rejected because their client exceeded the rate limit.",
+	})
+
+	artifactDownloadDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "artifact_download_duration_seconds",
+		Help:      "The time it took to download and unzip an artifact, by target and outcome (success/error).",
+		Buckets:   prometheus.ExponentialBuckets(0.1, 2, 12),
+	}, []string{"target", "outcome"})
+
+	artifactDownloadProgressBytes = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "artifact_download_progress_bytes",
+		Help:      "The number of bytes downloaded so far of the artifacts that are being downloaded, by target and artifact ID.",
+	}, []string{"target", "artifact_id"})
+
+	runLockWaitDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "run_lock_wait_duration_seconds",
+		Help:      "The time requests waited for another request to resolve the same workflow run, by target and outcome (success/error).",
+		Buckets:   prometheus.ExponentialBuckets(0.001, 2, 16),
+	}, []string{"target", "outcome"})
+
+	runLockTimeoutsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "run_lock_timeouts_total",
+		Help:      "The total number of requests that gave up waiting for another request to resolve the same workflow run, by target.",
+	}, []string{"target"})
+)
+
+// observeRunLockWait records how long a request waited for the resolution lock
+// of a workflow run, and whether it gave up because the wait timed out.
+func observeRunLockWait(targetID string, start time.Time, err error) {
+	outcome := outcomeSuccess
+	if err != nil {
+		outcome = outcomeError
+		if errors.Is(err, context.DeadlineExceeded) {
+			runLockTimeoutsTotal.WithLabelValues(targetID).Inc()
+		}
+	}
+	runLockWaitDuration.WithLabelValues(targetID, outcome).Observe(time.Since(start).Seconds())
+}
+
+func observeAPICall(targetID string, call string, err error) {
+	outcome := outcomeSuccess
+	if err != nil {
+		outcome = outcomeError
+	}
+	githubAPICallsTotal.WithLabelValues(targetID, call, outcome).Inc()
+}
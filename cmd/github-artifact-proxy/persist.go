@@ -0,0 +1,160 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// runsFilename is the name of the file in the download directory that the
+	// cached workflow runs are persisted to.
+	runsFilename = "runs.json"
+	// runsSaveInterval is how often the cached workflow runs are persisted,
+	// in addition to when the server shuts down.
+	runsSaveInterval = time.Minute
+)
+
+// persistedTarget holds the cached workflow runs of a target, along with the
+// workflow that they were looked up for.
+type persistedTarget struct {
+	Workflow persistedWorkflow `json:"workflow"`
+	Runs     map[string]*Run   `json:"runs"`
+}
+
+// persistedWorkflow holds the fields of a target that determine which
+// workflow runs are looked up for it, as compared by hasSameWorkflow.
+type persistedWorkflow struct {
+	Type         string        `json:"type,omitempty"`
+	Owner        string        `json:"owner"`
+	Repo         string        `json:"repo"`
+	Filenames    []string      `json:"filename,omitempty"`
+	BaseURL      *string       `json:"base_url,omitempty"`
+	LatestFilter *LatestFilter `json:"latest_filter,omitempty"`
+	ArtifactID   *int64        `json:"artifact_id,omitempty"`
+}
+
+func newPersistedWorkflow(t *Target) persistedWorkflow {
+	return persistedWorkflow{
+		Type:         t.Type,
+		Owner:        t.Owner,
+		Repo:         t.Repo,
+		Filenames:    t.Filenames,
+		BaseURL:      t.BaseURL,
+		LatestFilter: t.LatestFilter,
+		ArtifactID:   t.ArtifactID,
+	}
+}
+
+func (w *persistedWorkflow) target() *Target {
+	return &Target{
+		Type:         w.Type,
+		Owner:        w.Owner,
+		Repo:         w.Repo,
+		Filenames:    w.Filenames,
+		BaseURL:      w.BaseURL,
+		LatestFilter: w.LatestFilter,
+		ArtifactID:   w.ArtifactID,
+	}
+}
+
+func (s *Server) getRunsFilename() string {
+	return filepath.Join(s.DownloadDir, runsFilename)
+}
+
+// loadRuns restores the cached workflow runs of the targets from the download
+// directory. The runs of targets whose workflow changed in the meantime are
+// dropped. The restored runs keep their original fetch time, so they expire
+// as if the server never restarted.
+func (s *Server) loadRuns() error {
+	data, err := os.ReadFile(s.getRunsFilename())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	var targets map[string]*persistedTarget
+	if err := json.Unmarshal(data, &targets); err != nil {
+		return fmt.Errorf("parse %s: %w", runsFilename, err)
+	}
+
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	var restored int
+	for id, persisted := range targets {
+		target, ok := s.Config.Targets[id]
+		if !ok || target.AllowClientToken || !persisted.Workflow.target().hasSameWorkflow(target) {
+			continue
+		}
+
+		for name, run := range persisted.Runs {
+			target.runCache.Set(name, run)
+			restored++
+		}
+	}
+
+	log.WithField("amount", restored).Info("restored cached workflow runs")
+	return nil
+}
+
+// SaveRuns persists the cached workflow runs of the targets to the download
+// directory. The file is replaced atomically, so that a crash halfway through
+// doesn't leave a corrupt file behind. The runs of dynamic targets aren't
+// persisted.
+func (s *Server) SaveRuns() error {
+	s.m.Lock()
+	targets := make(map[string]*persistedTarget, len(s.Config.Targets))
+	for id, target := range s.Config.Targets {
+		// The run cache isn't used for these targets
+		if target.AllowClientToken {
+			continue
+		}
+		targets[id] = &persistedTarget{
+			Workflow: newPersistedWorkflow(target),
+			Runs:     target.runCache.Runs(),
+		}
+	}
+	s.m.Unlock()
+
+	data, err := json.Marshal(targets)
+	if err != nil {
+		return err
+	}
+
+	file, err := os.CreateTemp(s.DownloadDir, ".runs-*.json")
+	if err != nil {
+		return err
+	}
+
+	_, err = file.Write(data)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(file.Name(), s.getRunsFilename())
+	}
+	if err != nil {
+		os.Remove(file.Name())
+	}
+	return err
+}
+
+// persistRunsLoop persists the cached workflow runs every runsSaveInterval, so
+// that most of them survive a crash as well.
+func (s *Server) persistRunsLoop() {
+	ticker := time.NewTicker(runsSaveInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		if err := s.SaveRuns(); err != nil {
+			log.WithError(err).Error("unable to persist cached workflow runs")
+		}
+	}
+}
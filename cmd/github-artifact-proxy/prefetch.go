@@ -0,0 +1,203 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"sort"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// refreshCheckInterval is how often the refresh loop checks whether any
+	// targets are due to be refreshed.
+	refreshCheckInterval = 5 * time.Second
+	// minRefreshInterval is the shortest refresh interval that targets can
+	// have, to stay clear of the rate limit of the GitHub API.
+	minRefreshInterval = 30 * time.Second
+)
+
+// prefetchLoop prefetches the artifacts of the latest workflow run of every
+// target right away, and then again every PrefetchInterval if it's set.
+func (s *Server) prefetchLoop() {
+	for {
+		s.prefetchTargets(context.Background())
+		if s.PrefetchInterval <= 0 {
+			return
+		}
+		time.Sleep(s.PrefetchInterval)
+	}
+}
+
+// prefetchTargets looks up the latest workflow run of every target and
+// downloads its artifacts, so that the first requests for them don't have to
+// wait. Targets are handled one after another, to avoid a burst of GitHub API
+// calls. The downloads respect the limit on the number of concurrent
+// downloads like any other.
+func (s *Server) prefetchTargets(ctx context.Context) {
+	targets := s.getPrefetchTargets()
+	ids := make([]string, 0, len(targets))
+	for id := range targets {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	log.WithField("amount", len(ids)).Info("prefetching the latest artifacts of targets")
+	for _, id := range ids {
+		s.prefetchTarget(ctx, log.WithField("target", id), id, targets[id])
+	}
+	log.Info("prefetched the latest artifacts of targets")
+}
+
+// getPrefetchTargets returns the targets of which the latest artifacts can be
+// prefetched. Targets that allow client tokens have no token to do so with,
+// and release assets are left out.
+func (s *Server) getPrefetchTargets() map[string]*Target {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	targets := make(map[string]*Target)
+	for id, target := range s.Config.Targets {
+		if !target.AllowClientToken && !target.isRelease() {
+			targets[id] = target
+		}
+	}
+	return targets
+}
+
+// prefetchTarget refreshes the cached latest workflow run of the given target
+// and downloads the artifacts of that run that aren't cached yet.
+func (s *Server) prefetchTarget(ctx context.Context, logCtx *log.Entry, targetID string, target *Target) {
+	client, err := s.getClient(target)
+	if err != nil {
+		logCtx.WithError(err).Error("unable to create github client")
+		return
+	}
+
+	// The request is only there to carry the context through the code that
+	// usually handles requests
+	r, err := http.NewRequestWithContext(ctx, http.MethodGet, "/", nil)
+	if err != nil {
+		logCtx.WithError(err).Error("unable to prepare prefetch request")
+		return
+	}
+
+	if err := target.runCache.Lock(ctx, "latest"); err != nil {
+		logCtx.WithError(err).Error("unable to acquire run lock")
+		return
+	}
+	run, ok := s.fetchRun(discardResponseWriter{}, r, logCtx, targetID, target, client, "latest", 0)
+	if ok {
+		target.runCache.Set("latest", run)
+	}
+	target.runCache.Unlock("latest")
+	if !ok {
+		logCtx.Error("unable to prefetch the latest workflow run")
+		return
+	}
+
+	// Only the requested files are extracted in this mode, so there's
+	// nothing to extract ahead of time
+	if s.UnzipSingleFile {
+		return
+	}
+
+	for _, artifact := range run.Artifacts {
+		if artifact.ID == nil || artifact.GetExpired() {
+			continue
+		}
+
+		logCtx := logCtx.WithFields(log.Fields{
+			"artifact": artifact.GetName(),
+			"id":       *artifact.ID,
+		})
+		if maxSize := s.getMaxArtifactSize(target); maxSize > 0 && artifact.GetSizeInBytes() > maxSize {
+			logCtx.WithField("max_size", maxSize).Warn("not prefetching artifact that exceeds the maximum size")
+			continue
+		}
+
+		if s.memCache != nil {
+			key := getMemArtifactKey(target.getArtifactKey(*artifact.ID))
+			if _, ok := s.memCache.Get(key); ok {
+				continue
+			}
+			if _, ok := s.fetchMemoryEntry(discardResponseWriter{}, r, logCtx, key, func(dlCtx context.Context) error {
+				return s.downloadArtifactToMemory(dlCtx, logCtx, targetID, target, client, *artifact.ID)
+			}); ok {
+				logCtx.Info("prefetched artifact")
+			}
+			continue
+		}
+
+		dlDir := s.getArtifactCacheDir(target.getArtifactKey(*artifact.ID))
+		if isArtifactComplete(dlDir) {
+			continue
+		}
+		if target.isProtected() {
+			if err := markArtifactProtected(dlDir); err != nil {
+				logCtx.WithError(err).Error("unable to mark artifact as protected")
+				continue
+			}
+		}
+		if err := s.fetchArtifact(ctx, logCtx, targetID, target, client, *artifact.ID, ""); err != nil {
+			logCtx.WithError(err).Error("unable to prefetch artifact")
+			continue
+		}
+		logCtx.Info("prefetched artifact")
+	}
+}
+
+// refreshLoop looks up the latest workflow run of every target with a refresh
+// interval in the background, and downloads its artifacts, so that requests
+// for the latest artifacts always hit the cache. The targets are read from the
+// config on every check, so that config reloads are picked up. A target isn't
+// refreshed again while its previous refresh is still running.
+func (s *Server) refreshLoop() {
+	ticker := time.NewTicker(refreshCheckInterval)
+	defer ticker.Stop()
+
+	done := make(chan string)
+	running := make(map[string]bool)
+	lastRefresh := make(map[string]time.Time)
+	for {
+		select {
+		case id := <-done:
+			delete(running, id)
+		case now := <-ticker.C:
+			targets := s.getRefreshTargets()
+			for id := range lastRefresh {
+				if _, ok := targets[id]; !ok {
+					delete(lastRefresh, id)
+				}
+			}
+
+			for id, target := range targets {
+				if running[id] || now.Sub(lastRefresh[id]) < target.refreshInterval {
+					continue
+				}
+
+				running[id] = true
+				lastRefresh[id] = now
+				go func(id string, target *Target) {
+					s.prefetchTarget(context.Background(), log.WithField("target", id), id, target)
+					done <- id
+				}(id, target)
+			}
+		}
+	}
+}
+
+// getRefreshTargets returns the targets that have a refresh interval.
+func (s *Server) getRefreshTargets() map[string]*Target {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	targets := make(map[string]*Target)
+	for id, target := range s.Config.Targets {
+		if target.refreshInterval > 0 {
+			targets[id] = target
+		}
+	}
+	return targets
+}
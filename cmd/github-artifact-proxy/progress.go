@@ -0,0 +1,69 @@
+package main
+
+import (
+	"io"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+)
+
+// progressLogInterval is how often the progress of an artifact download is
+// logged. Downloads that finish sooner aren't logged at all.
+const progressLogInterval = 10 * time.Second
+
+// progressReader keeps track of the number of bytes read from the underlying
+// reader, to report the progress of a download.
+type progressReader struct {
+	r      io.Reader
+	logCtx *log.Entry
+	gauge  prometheus.Gauge
+	// total is the expected size of the download, or -1 if it's not known
+	total   int64
+	read    int64
+	start   time.Time
+	lastLog time.Time
+}
+
+func (p *progressReader) Read(b []byte) (int, error) {
+	n, err := p.r.Read(b)
+	p.read += int64(n)
+	p.gauge.Set(float64(p.read))
+
+	if now := time.Now(); now.Sub(p.lastLog) >= progressLogInterval {
+		p.lastLog = now
+		fields := log.Fields{
+			"downloaded": p.read,
+			"rate":       int64(float64(p.read) / now.Sub(p.start).Seconds()),
+		}
+		if p.total >= 0 {
+			fields["total"] = p.total
+			if p.total > 0 {
+				fields["percent"] = p.read * 100 / p.total
+			}
+		}
+		p.logCtx.WithFields(fields).Info("artifact download in progress")
+	}
+
+	return n, err
+}
+
+// copyWithProgress copies the ZIP file of the artifact with the given ID from
+// src to dst, like io.Copy. Meanwhile, the progress is logged periodically and
+// exposed through a gauge, which is removed again once the download is done.
+// The rate is logged in bytes per second.
+func copyWithProgress(dst io.Writer, src io.Reader, logCtx *log.Entry, targetID string, artifactID int64, total int64) (int64, error) {
+	labels := []string{targetID, strconv.FormatInt(artifactID, 10)}
+	defer artifactDownloadProgressBytes.DeleteLabelValues(labels...)
+
+	now := time.Now()
+	return io.Copy(dst, &progressReader{
+		r:       src,
+		logCtx:  logCtx,
+		gauge:   artifactDownloadProgressBytes.WithLabelValues(labels...),
+		total:   total,
+		start:   now,
+		lastLog: now,
+	})
+}
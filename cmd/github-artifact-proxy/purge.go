@@ -0,0 +1,85 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/julienschmidt/httprouter"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	purgeSecretHeader = "X-Purge-Secret"
+)
+
+type Purge struct {
+	Secret string `yaml:"secret"`
+}
+
+func (s *Server) handlePurgeRequest(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	targetId := params.ByName("target")
+	runName := r.URL.Query().Get("run")
+	logCtx := requestLogger(r.Context()).WithFields(log.Fields{
+		"addr":   r.RemoteAddr,
+		"path":   r.URL.Path,
+		"target": targetId,
+		"run":    runName,
+	})
+	logCtx.Info("handling purge request")
+
+	purge := s.getPurge()
+	if purge == nil {
+		logCtx.Warn("purging not configured")
+		httpError(w, r, http.StatusNotFound)
+		return
+	}
+
+	secret := r.Header.Get(purgeSecretHeader)
+	if !secureCompare(secret, purge.Secret) {
+		logCtx.Warn("invalid purge secret")
+		httpError(w, r, http.StatusUnauthorized)
+		return
+	}
+
+	target, ok := s.getTarget(targetId)
+	if !ok {
+		logCtx.Warn("target not found")
+		httpError(w, r, http.StatusNotFound)
+		return
+	}
+
+	if runName == "" {
+		target.runCache.ClearLists()
+	}
+	purged := target.runCache.DeleteFunc(func(name string, run *Run) bool {
+		// Purge the cached attempts of the run as well
+		return runName == "" || name == runName || strings.HasPrefix(name, runName+"/attempts/")
+	})
+
+	for name, run := range purged {
+		for _, af := range run.Artifacts {
+			if af.ID == nil {
+				continue
+			}
+			if target.isRelease() {
+				s.deleteReleaseAsset(r.Context(), logCtx, target.getArtifactKey(*af.ID))
+			} else {
+				s.deleteArtifact(r.Context(), logCtx, target.getArtifactKey(*af.ID))
+			}
+		}
+
+		logCtx.WithFields(log.Fields{
+			"run":    name,
+			"run_id": run.ID,
+		}).Info("purged cached run")
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) getPurge() *Purge {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	return s.Config.Purge
+}
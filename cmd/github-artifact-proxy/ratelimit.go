@@ -0,0 +1,79 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/google/go-github/v60/github"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// rateLimitWarnRatio is the fraction of the rate limit of a token below
+	// which we start logging warnings.
+	rateLimitWarnRatio = 0.1
+)
+
+// rateLimitTransport keeps track of the remaining GitHub API rate limit of a
+// token, based on the rate limit headers in the API responses.
+type rateLimitTransport struct {
+	base    http.RoundTripper
+	tokenID string
+}
+
+func (t *rateLimitTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	base := t.base
+	if base == nil {
+		base = http.DefaultTransport
+	}
+
+	res, err := base.RoundTrip(req)
+	if err != nil {
+		return res, err
+	}
+
+	limit, err := strconv.Atoi(res.Header.Get("X-RateLimit-Limit"))
+	if err != nil {
+		return res, nil
+	}
+	remaining, err := strconv.Atoi(res.Header.Get("X-RateLimit-Remaining"))
+	if err != nil {
+		return res, nil
+	}
+
+	githubRateLimitRemaining.WithLabelValues(t.tokenID).Set(float64(remaining))
+	if float64(remaining) < float64(limit)*rateLimitWarnRatio {
+		logCtx := requestLogger(req.Context()).WithFields(log.Fields{
+			"token":     t.tokenID,
+			"limit":     limit,
+			"remaining": remaining,
+		})
+		if reset, err := strconv.ParseInt(res.Header.Get("X-RateLimit-Reset"), 10, 64); err == nil {
+			logCtx = logCtx.WithField("reset", time.Unix(reset, 0))
+		}
+		logCtx.Warn("github api rate limit almost exhausted")
+	}
+
+	return res, nil
+}
+
+// getRateLimitRetryAfter returns how long to wait before retrying if the given
+// error was caused by hitting a GitHub API rate limit.
+func getRateLimitRetryAfter(err error) (time.Duration, bool) {
+	var rateErr *github.RateLimitError
+	if errors.As(err, &rateErr) {
+		return max(time.Until(rateErr.Rate.Reset.Time), time.Second), true
+	}
+
+	var abuseErr *github.AbuseRateLimitError
+	if errors.As(err, &abuseErr) {
+		if abuseErr.RetryAfter != nil {
+			return max(*abuseErr.RetryAfter, time.Second), true
+		}
+		return time.Minute, true
+	}
+
+	return 0, false
+}
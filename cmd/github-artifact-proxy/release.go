@@ -0,0 +1,315 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/google/go-github/v60/github"
+	"github.com/julienschmidt/httprouter"
+	log "github.com/sirupsen/logrus"
+)
+
+// fetchRelease retrieves the release with the given tag, or the latest release
+// if the tag is "latest", from the GitHub API. The assets of the release are
+// returned as the artifacts of a Run, so that releases are cached and looked up
+// in the same way as workflow runs. If that fails, an error response is
+// written and false is returned.
+func (s *Server) fetchRelease(w http.ResponseWriter, r *http.Request, logCtx *log.Entry, targetID string, target *Target, client *github.Client, tag string) (*Run, bool) {
+	var release *github.RepositoryRelease
+	var ghRes *github.Response
+	err := withRetry(r.Context(), logCtx, s.GithubMaxAttempts, func() (*github.Response, error) {
+		var err error
+		if tag == "latest" {
+			release, ghRes, err = client.Repositories.GetLatestRelease(r.Context(), target.Owner, target.Repo)
+			observeAPICall(targetID, "get_latest_release", err)
+		} else {
+			release, ghRes, err = client.Repositories.GetReleaseByTag(r.Context(), target.Owner, target.Repo, tag)
+			observeAPICall(targetID, "get_release_by_tag", err)
+		}
+		return ghRes, err
+	})
+	if err != nil {
+		writeGithubError(w, r, logCtx, ghRes, err, "unable to obtain release")
+		return nil, false
+	}
+
+	logCtx.WithFields(log.Fields{
+		"tag":    release.GetTagName(),
+		"amount": len(release.Assets),
+	}).Info("retrieved release")
+
+	return &Run{
+		ID:        release.GetID(),
+		Artifacts: releaseAssetArtifacts(release.Assets),
+		FetchTime: time.Now(),
+	}, true
+}
+
+// releaseAssetArtifacts converts the given release assets to artifacts. Assets
+// that haven't been fully uploaded yet are skipped.
+func releaseAssetArtifacts(assets []*github.ReleaseAsset) []*github.Artifact {
+	artifacts := make([]*github.Artifact, 0, len(assets))
+	for _, asset := range assets {
+		if asset.GetState() != "" && asset.GetState() != "uploaded" {
+			continue
+		}
+
+		artifacts = append(artifacts, &github.Artifact{
+			ID:          asset.ID,
+			Name:        asset.Name,
+			SizeInBytes: github.Int64(int64(asset.GetSize())),
+			CreatedAt:   asset.CreatedAt,
+			UpdatedAt:   asset.UpdatedAt,
+		})
+	}
+	return artifacts
+}
+
+// handleReleaseAssetRequest serves the requested asset of a release. Release
+// assets are single files, so they're served as is instead of being
+// extracted. The metadata of the asset is returned if JSON was requested.
+func (s *Server) handleReleaseAssetRequest(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	targetId := params.ByName("target")
+	tag := params.ByName("run")
+	assetName := params.ByName("artifact")
+	logCtx := requestLogger(r.Context()).WithFields(log.Fields{
+		"addr":   r.RemoteAddr,
+		"path":   r.URL.Path,
+		"target": targetId,
+		"asset":  assetName,
+		"tag":    tag,
+	})
+	logCtx.Info("handling release asset request")
+
+	target, ok := s.getTarget(targetId)
+	if !ok {
+		logCtx.Warn("target not found")
+		httpError(w, r, http.StatusNotFound)
+		return
+	}
+
+	if !authorizeTarget(w, r, logCtx, target) {
+		return
+	}
+	writeTargetHeaders(w, target)
+
+	outcome := outcomeError
+	defer func() {
+		requestsTotal.WithLabelValues(targetId, outcome).Inc()
+	}()
+
+	client, ok := s.getRequestClient(w, r, logCtx, target)
+	if !ok {
+		return
+	}
+
+	asset, ok := s.resolveArtifact(w, r, logCtx, targetId, target, client, tag, assetName)
+	if !ok {
+		return
+	}
+
+	w.Header().Add("Vary", "Accept")
+	if requestsJSON(r) {
+		outcome = outcomeHit
+		writeJSON(w, logCtx, http.StatusOK, newArtifactInfo(asset))
+		return
+	}
+	if !s.checkArtifactSize(w, r, logCtx, target, asset) {
+		return
+	}
+
+	if s.memCache != nil {
+		outcome = s.serveMemoryReleaseAsset(w, r, logCtx, targetId, target, client, asset)
+		return
+	}
+
+	dir := s.getReleaseAssetCacheDir(target.getArtifactKey(*asset.ID))
+	if isArtifactComplete(dir) {
+		logCtx.Info("serving cached release asset")
+
+		outcome = outcomeHit
+		s.serveArtifactInline(w, r, logCtx, *asset.ID, http.Dir(dir), asset.GetName())
+		return
+	}
+
+	if err := s.fetchReleaseAsset(r.Context(), logCtx, targetId, target, client, asset); err != nil {
+		s.writeFetchError(w, r, logCtx, err)
+		return
+	}
+
+	logCtx.Info("serving downloaded release asset")
+
+	outcome = outcomeMiss
+	writeCacheHeaders(w)
+	s.serveArtifactInline(w, r, logCtx, *asset.ID, http.Dir(dir), asset.GetName())
+}
+
+// fetchReleaseAsset downloads the given release asset, unless that already
+// happened. Concurrent calls for the same asset are coalesced into a single
+// download.
+func (s *Server) fetchReleaseAsset(ctx context.Context, logCtx *log.Entry, targetID string, target *Target, client *github.Client, asset *github.Artifact) error {
+	key := "release/" + target.getArtifactKey(asset.GetID())
+	return s.coalesceDownload(ctx, logCtx, key, func(dlCtx context.Context) error {
+		return s.downloadReleaseAsset(dlCtx, logCtx, targetID, target, client, asset)
+	})
+}
+
+// downloadReleaseAsset downloads the given release asset to its directory in
+// the download directory while holding the release asset lock. The download
+// is aborted once the given context is done.
+func (s *Server) downloadReleaseAsset(dlCtx context.Context, logCtx *log.Entry, targetID string, target *Target, client *github.Client, asset *github.Artifact) error {
+	assetKey := target.getArtifactKey(asset.GetID())
+	name := asset.GetName()
+	if err := checkReleaseAssetName(name); err != nil {
+		return err
+	}
+
+	waitCtx, waitCancel := s.withDownloadTimeout(dlCtx)
+	defer waitCancel()
+
+	if err := s.releaseAssetLocks.Lock(waitCtx, assetKey); err != nil {
+		return fmt.Errorf("acquire release asset lock: %w", err)
+	}
+	defer s.releaseAssetLocks.Unlock(assetKey)
+
+	dir := s.getReleaseAssetCacheDir(assetKey)
+	if isArtifactComplete(dir) {
+		return nil
+	}
+
+	releaseSlot, err := s.acquireDownloadSlot(waitCtx, logCtx)
+	if err != nil {
+		return err
+	}
+	defer releaseSlot()
+
+	// Waiting for the lock and a download slot doesn't count towards the
+	// download timeout
+	ctx, cancel := s.withDownloadTimeout(dlCtx)
+	defer cancel()
+
+	logCtx.Info("downloading release asset")
+
+	dlStart := time.Now()
+	dlOutcome := outcomeError
+	defer func() {
+		artifactDownloadDuration.WithLabelValues(targetID, dlOutcome).Observe(time.Since(dlStart).Seconds())
+	}()
+
+	// Download the release asset next to its final location, so that it only
+	// becomes visible once it's complete
+	tempDir, err := createTempArtifactDir(dir)
+	if err != nil {
+		return fmt.Errorf("create directory to download the release asset to: %w", err)
+	}
+
+	file, err := os.Create(filepath.Join(tempDir, name))
+	if err != nil {
+		deleteTempDir(logCtx, tempDir)
+		return fmt.Errorf("create release asset file: %w", err)
+	}
+
+	err = s.downloadReleaseAssetFile(ctx, logCtx, targetID, target, client, asset.GetID(), file)
+	if closeErr := file.Close(); err == nil && closeErr != nil {
+		err = fmt.Errorf("close release asset file: %w", closeErr)
+	}
+	if err != nil {
+		deleteTempDir(logCtx, tempDir)
+		return err
+	}
+
+	if err := replaceArtifactDir(tempDir, dir); err != nil {
+		deleteTempDir(logCtx, tempDir)
+		return fmt.Errorf("move release asset into place: %w", err)
+	}
+
+	dlOutcome = outcomeSuccess
+	return nil
+}
+
+// checkReleaseAssetName returns an error if the given release asset name can't
+// be used as a file name.
+func checkReleaseAssetName(name string) error {
+	if name == "" || name == "." || name == ".." || strings.ContainsAny(name, `/\`) {
+		return fmt.Errorf("invalid release asset name: '%s'", name)
+	}
+	return nil
+}
+
+// downloadReleaseAssetFile downloads the release asset with the given ID from
+// GitHub to the given file.
+func (s *Server) downloadReleaseAssetFile(ctx context.Context, logCtx *log.Entry, targetID string, target *Target, client *github.Client, assetID int64, dst io.Writer) error {
+	var rc io.ReadCloser
+	var redirectURL string
+	err := withRetry(ctx, logCtx, s.GithubMaxAttempts, func() (*github.Response, error) {
+		var err error
+		rc, redirectURL, err = client.Repositories.DownloadReleaseAsset(ctx, target.Owner, target.Repo, assetID, nil)
+		observeAPICall(targetID, "download_release_asset", err)
+
+		// The response is only available for errors returned by the API
+		var errRes *github.ErrorResponse
+		if errors.As(err, &errRes) {
+			return &github.Response{Response: errRes.Response}, err
+		}
+		return nil, err
+	})
+	if err != nil {
+		return fmt.Errorf("obtain release asset: %w", err)
+	}
+
+	// GitHub usually redirects to the storage backend rather than serving the
+	// asset itself
+	if rc == nil {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, redirectURL, nil)
+		if err != nil {
+			return fmt.Errorf("prepare release asset download http request: %w", err)
+		}
+
+		res, err := s.dlClient.Do(req)
+		if err != nil {
+			return fmt.Errorf("download release asset: %w", err)
+		}
+		if res.StatusCode != http.StatusOK {
+			res.Body.Close()
+			return fmt.Errorf("download release asset: unexpected status code: %d", res.StatusCode)
+		}
+		rc = res.Body
+	}
+	defer rc.Close()
+
+	n, err := io.Copy(dst, rc)
+	artifactDownloadBytesTotal.WithLabelValues(targetID).Add(float64(n))
+	if err != nil {
+		return fmt.Errorf("download release asset: %w", err)
+	}
+
+	return nil
+}
+
+// deleteReleaseAsset removes the downloaded release asset with the given key
+// from disk. It waits for any ongoing download of the asset to finish first.
+func (s *Server) deleteReleaseAsset(ctx context.Context, logCtx *log.Entry, assetKey string) {
+	if s.memCache != nil {
+		s.memCache.Remove(getMemReleaseAssetKey(assetKey))
+		return
+	}
+
+	if err := s.releaseAssetLocks.Lock(ctx, assetKey); err != nil {
+		logCtx.WithError(err).WithField("asset_key", assetKey).Error("unable to acquire release asset lock")
+		return
+	}
+	defer s.releaseAssetLocks.Unlock(assetKey)
+
+	deleteDir(logCtx, s.getReleaseAssetCacheDir(assetKey))
+}
+
+func (s *Server) getReleaseAssetCacheDir(assetKey string) string {
+	return filepath.Join(s.DownloadDir, "releases", assetKey)
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+	"regexp"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	requestIDHeader = "X-Request-Id"
+)
+
+// requestIDRegex matches the request IDs we accept from upstream proxies.
+var requestIDRegex = regexp.MustCompile("^[A-Za-z0-9._-]{1,128}$")
+
+type requestIDKey struct{}
+
+// withRequestID attaches a request ID to the request context and the
+// response. A valid request ID set by an upstream proxy is reused, so that log
+// lines can be correlated across services.
+func withRequestID(w http.ResponseWriter, r *http.Request) *http.Request {
+	id := r.Header.Get(requestIDHeader)
+	if !requestIDRegex.MatchString(id) {
+		id = newRequestID()
+	}
+
+	w.Header().Set(requestIDHeader, id)
+	return r.WithContext(context.WithValue(r.Context(), requestIDKey{}, id))
+}
+
+// requestLogger returns a log entry that includes the ID of the request that
+// the given context belongs to.
+func requestLogger(ctx context.Context) *log.Entry {
+	if id, ok := ctx.Value(requestIDKey{}).(string); ok {
+		return log.WithField("request_id", id)
+	}
+	return log.NewEntry(log.StandardLogger())
+}
+
+func newRequestID() string {
+	var buf [16]byte
+	if _, err := rand.Read(buf[:]); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(buf[:])
+}
@@ -0,0 +1,591 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/go-github/v60/github"
+	log "github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	// shaSearchPageSize is the number of recent workflow runs that are searched
+	// for a match when a run is requested by an abbreviated commit SHA.
+	shaSearchPageSize = 100
+	// conclusionSearchPageSize is the number of recent workflow runs that are
+	// searched for a match when the latest run is filtered by conclusion.
+	conclusionSearchPageSize = 100
+	// artifactsPageSize is the number of artifacts requested per page when
+	// listing the artifacts of a workflow run. This is the maximum that the
+	// GitHub API allows.
+	artifactsPageSize = 100
+)
+
+var commitSHARegex = regexp.MustCompile("^[0-9a-f]{7,40}$")
+
+// resolveArtifact looks up the artifact with the given name in the given
+// workflow run of the target. A specific attempt of the workflow run can be
+// selected with the "attempt" query parameter. Workflow runs are served from
+// the target's run cache if possible, unless the target allows client tokens.
+// If the artifact could not be resolved,
+// an error response is written and false is returned.
+func (s *Server) resolveArtifact(w http.ResponseWriter, r *http.Request, logCtx *log.Entry, targetID string, target *Target, client *github.Client, runName string, artifactName string) (*github.Artifact, bool) {
+	attempt, err := parseRunAttempt(r)
+	if err != nil {
+		logCtx.WithError(err).Warn("unable to parse run attempt")
+		httpError(w, r, http.StatusBadRequest)
+		return nil, false
+	}
+
+	// Attempts are cached separately from the workflow run itself
+	cacheKey := runName
+	if attempt != 0 {
+		cacheKey = fmt.Sprintf("%s/attempts/%d", runName, attempt)
+		logCtx = logCtx.WithField("attempt", attempt)
+	}
+
+	var cachedRun *Run
+	var ok bool
+	if target.AllowClientToken {
+		// Every client has to prove that its token can access the workflow run,
+		// so the run cache is bypassed
+		if cachedRun, ok = s.fetchRun(w, r, logCtx, targetID, target, client, runName, attempt); !ok {
+			return nil, false
+		}
+	} else if cachedRun, ok = target.runCache.Get(cacheKey); ok && s.StaleWhileRevalidate && time.Since(cachedRun.FetchTime) > s.getCacheTTL(target) {
+		// Serve an expired run straight away if we're allowed to, and refresh
+		// it in the background
+		runCacheTotal.WithLabelValues(targetID, outcomeStale).Inc()
+		s.revalidateRun(r, logCtx, targetID, target, client, runName, attempt, cacheKey, artifactName)
+	} else {
+		lockCtx, cancel := context.WithTimeout(r.Context(), runLockTimeout)
+		defer cancel()
+		lockStart := time.Now()
+		err := target.runCache.Lock(lockCtx, cacheKey)
+		observeRunLockWait(targetID, lockStart, err)
+		if err != nil {
+			logCtx.WithError(err).WithField("timeout", runLockTimeout).Error("unable to acquire run lock")
+			if requestTimedOut(r) {
+				httpError(w, r, http.StatusGatewayTimeout)
+			} else {
+				httpError(w, r, http.StatusNotFound)
+			}
+			return nil, false
+		}
+		defer target.runCache.Unlock(cacheKey)
+
+		cachedRun, ok = target.runCache.Get(cacheKey)
+		if !ok || time.Since(cachedRun.FetchTime) > s.getCacheTTL(target) {
+			runCacheTotal.WithLabelValues(targetID, outcomeMiss).Inc()
+
+			if cachedRun, ok = s.fetchRun(w, r, logCtx, targetID, target, client, runName, attempt); !ok {
+				return nil, false
+			}
+			target.runCache.Set(cacheKey, cachedRun)
+		} else {
+			runCacheTotal.WithLabelValues(targetID, outcomeHit).Inc()
+		}
+	}
+
+	artifact := findArtifact(cachedRun.Artifacts, artifactName, target.CaseInsensitive)
+	if artifact == nil || artifact.ID == nil {
+		logCtx.Warn("artifact not found")
+		httpError(w, r, http.StatusNotFound)
+		return nil, false
+	}
+
+	logCtx.WithFields(log.Fields{
+		"id":         *artifact.ID,
+		"created_at": artifact.CreatedAt,
+	}).Info("found artifact")
+
+	return artifact, true
+}
+
+// fetchRun retrieves the workflow run with the given name, or the given attempt
+// of it, along with its artifacts from the GitHub API. If that fails, an error
+// response is written and false is returned.
+func (s *Server) fetchRun(w http.ResponseWriter, r *http.Request, logCtx *log.Entry, targetID string, target *Target, client *github.Client, runName string, attempt int) (res *Run, ok bool) {
+	ctx, span := tracer.Start(r.Context(), "fetchRun", trace.WithAttributes(
+		attribute.String("run", runName),
+		attribute.Int("attempt", attempt),
+	))
+	defer func() {
+		if !ok {
+			span.SetStatus(codes.Error, "unable to fetch workflow run")
+		}
+		span.End()
+	}()
+	r = r.WithContext(ctx)
+
+	if target.isRelease() {
+		if attempt != 0 {
+			logCtx.Warn("releases don't have attempts")
+			httpError(w, r, http.StatusBadRequest)
+			return nil, false
+		}
+		return s.fetchRelease(w, r, logCtx, targetID, target, client, runName)
+	}
+	if target.isPinned() {
+		if runName != "latest" || attempt != 0 {
+			logCtx.Warn("targets pinned to an artifact only have a latest run")
+			httpError(w, r, http.StatusNotFound)
+			return nil, false
+		}
+		return s.fetchPinnedArtifact(w, r, logCtx, targetID, target, client)
+	}
+
+	run, ok := s.resolveRun(w, r, logCtx, targetID, target, client, runName)
+	if !ok {
+		return nil, false
+	}
+
+	if attempt != 0 {
+		run, ok = s.getRunAttempt(w, r, logCtx, targetID, target, client, *run.ID, attempt)
+		if !ok {
+			return nil, false
+		}
+	}
+
+	artifacts, ok := s.listRunArtifacts(w, r, logCtx, targetID, target, client, *run.ID)
+	if !ok {
+		return nil, false
+	}
+
+	if attempt != 0 {
+		artifacts = filterAttemptArtifacts(artifacts, run)
+	}
+
+	return &Run{
+		ID:        *run.ID,
+		Artifacts: artifacts,
+		FetchTime: time.Now(),
+	}, true
+}
+
+// revalidateRun refreshes the cached workflow run with the given cache key in
+// the background, unless that's already happening. If the refreshed run has a
+// different artifact with the given name, that artifact is downloaded right
+// away as well, so that it's ready for the next request.
+func (s *Server) revalidateRun(r *http.Request, logCtx *log.Entry, targetID string, target *Target, client *github.Client, runName string, attempt int, cacheKey string, artifactName string) {
+	if !target.runCache.TryLock(cacheKey) {
+		return
+	}
+
+	logCtx.Info("refreshing expired workflow run in the background")
+
+	// The request may be done before we are
+	bgReq := r.Clone(context.Background())
+	go func() {
+		defer target.runCache.Unlock(cacheKey)
+
+		oldRun, _ := target.runCache.Get(cacheKey)
+		run, ok := s.fetchRun(discardResponseWriter{}, bgReq, logCtx, targetID, target, client, runName, attempt)
+		if !ok {
+			return
+		}
+		target.runCache.Set(cacheKey, run)
+
+		artifact := findArtifact(run.Artifacts, artifactName, target.CaseInsensitive)
+		if artifact == nil || artifact.ID == nil || artifact.GetExpired() || (s.UnzipSingleFile && !target.isRelease()) {
+			return
+		}
+		if oldRun != nil {
+			if oldArtifact := findArtifact(oldRun.Artifacts, artifactName, target.CaseInsensitive); oldArtifact != nil && oldArtifact.GetID() == *artifact.ID {
+				return
+			}
+		}
+
+		logCtx := logCtx.WithField("id", *artifact.ID)
+		logCtx.Info("downloading the new artifact of the refreshed workflow run")
+		var err error
+		if target.isRelease() {
+			err = s.fetchReleaseAsset(context.Background(), logCtx, targetID, target, client, artifact)
+		} else {
+			err = s.fetchArtifact(context.Background(), logCtx, targetID, target, client, *artifact.ID, "")
+		}
+		if err != nil {
+			logCtx.WithError(err).Error("unable to download the new artifact of the refreshed workflow run")
+		}
+	}()
+}
+
+// discardResponseWriter is passed to request handling code that runs in the
+// background, where there's no client to write a response to.
+type discardResponseWriter struct{}
+
+func (discardResponseWriter) Header() http.Header {
+	return http.Header{}
+}
+
+func (discardResponseWriter) Write(b []byte) (int, error) {
+	return len(b), nil
+}
+
+func (discardResponseWriter) WriteHeader(int) {}
+
+// resolveRun looks up the workflow run of the target with the given name. The
+// name is either "latest", a commit SHA or a numeric workflow run ID. If the
+// run could not be resolved, an error response is written and false is
+// returned.
+func (s *Server) resolveRun(w http.ResponseWriter, r *http.Request, logCtx *log.Entry, targetID string, target *Target, client *github.Client, runName string) (*github.WorkflowRun, bool) {
+	switch {
+	case runName == "latest":
+		return s.getLatestRun(w, r, logCtx, targetID, target, client)
+	case isCommitSHA(runName):
+		return s.getRunByCommitSHA(w, r, logCtx, targetID, target, client, runName)
+	default:
+		runID, err := strconv.ParseInt(runName, 10, 64)
+		if err != nil {
+			logCtx.WithError(err).Warn("unable the parse run ID")
+			httpError(w, r, http.StatusBadRequest)
+			return nil, false
+		}
+		return s.getRunByID(w, r, logCtx, targetID, target, client, runID)
+	}
+}
+
+func (s *Server) getLatestRun(w http.ResponseWriter, r *http.Request, logCtx *log.Entry, targetID string, target *Target, client *github.Client) (*github.WorkflowRun, bool) {
+	listOpts := github.ListWorkflowRunsOptions{}
+	if target.LatestFilter != nil {
+		if target.LatestFilter.Branch != nil {
+			listOpts.Branch = *target.LatestFilter.Branch
+		}
+		if target.LatestFilter.Event != nil {
+			listOpts.Event = *target.LatestFilter.Event
+		}
+		if target.LatestFilter.Status != nil {
+			listOpts.Status = *target.LatestFilter.Status
+		}
+		if target.LatestFilter.Conclusion != nil {
+			listOpts.PerPage = conclusionSearchPageSize
+		}
+	}
+
+	runs, ok := s.listWorkflowRuns(w, r, logCtx, targetID, target, client, &listOpts)
+	if !ok {
+		return nil, false
+	}
+
+	if target.LatestFilter != nil && target.LatestFilter.Conclusion != nil {
+		runs = filterRunsByConclusion(runs, *target.LatestFilter.Conclusion)
+	}
+
+	if len(runs) == 0 {
+		// Without a filter, this means that the workflow hasn't run yet, which
+		// is common for new repositories. Tell that apart from a typo in the
+		// config, which results in a 404 from the GitHub API instead.
+		if target.LatestFilter == nil {
+			logCtx.Warn("no workflow runs found for this workflow")
+			httpErrorDetail(w, r, http.StatusNotFound, "no workflow runs found for this workflow")
+			return nil, false
+		}
+
+		logCtx.Warn("no workflow runs match the latest filter")
+		httpErrorDetail(w, r, http.StatusNotFound, "no workflow runs match the latest filter")
+		return nil, false
+	}
+
+	// We assume that the first workflow run in the list is the latest one. Luckily this
+	// appears to always be the case, because there seems to be no way to specify
+	// a sorting preference.
+	return runs[0], true
+}
+
+// getRunByCommitSHA returns the latest workflow run for the given commit. The
+// GitHub API can only filter on full commit SHAs, so abbreviated ones are
+// matched against the most recent workflow runs instead.
+func (s *Server) getRunByCommitSHA(w http.ResponseWriter, r *http.Request, logCtx *log.Entry, targetID string, target *Target, client *github.Client, sha string) (*github.WorkflowRun, bool) {
+	listOpts := github.ListWorkflowRunsOptions{}
+	if len(sha) == 40 {
+		listOpts.HeadSHA = sha
+	} else {
+		listOpts.PerPage = shaSearchPageSize
+	}
+
+	runs, ok := s.listWorkflowRuns(w, r, logCtx, targetID, target, client, &listOpts)
+	if !ok {
+		return nil, false
+	}
+
+	for _, run := range runs {
+		if strings.HasPrefix(run.GetHeadSHA(), sha) {
+			return run, true
+		}
+	}
+
+	logCtx.Warn("no workflow run found for commit")
+	httpError(w, r, http.StatusNotFound)
+	return nil, false
+}
+
+func (s *Server) getRunByID(w http.ResponseWriter, r *http.Request, logCtx *log.Entry, targetID string, target *Target, client *github.Client, runID int64) (*github.WorkflowRun, bool) {
+	var wfRun *github.WorkflowRun
+	var ghRes *github.Response
+	err := withRetry(r.Context(), logCtx, s.GithubMaxAttempts, func() (*github.Response, error) {
+		var err error
+		wfRun, ghRes, err = client.Actions.GetWorkflowRunByID(r.Context(), target.Owner, target.Repo, runID)
+		observeAPICall(targetID, "get_workflow_run", err)
+		return ghRes, err
+	})
+	if err != nil {
+		writeGithubError(w, r, logCtx, ghRes, err, "unable to obtain workflow run")
+		return nil, false
+	}
+
+	return wfRun, true
+}
+
+func (s *Server) getRunAttempt(w http.ResponseWriter, r *http.Request, logCtx *log.Entry, targetID string, target *Target, client *github.Client, runID int64, attempt int) (*github.WorkflowRun, bool) {
+	var wfRun *github.WorkflowRun
+	var ghRes *github.Response
+	err := withRetry(r.Context(), logCtx, s.GithubMaxAttempts, func() (*github.Response, error) {
+		var err error
+		wfRun, ghRes, err = client.Actions.GetWorkflowRunAttempt(r.Context(), target.Owner, target.Repo, runID, attempt, nil)
+		observeAPICall(targetID, "get_workflow_run_attempt", err)
+		return ghRes, err
+	})
+	if err != nil {
+		writeGithubError(w, r, logCtx, ghRes, err, "unable to obtain workflow run attempt")
+		return nil, false
+	}
+
+	return wfRun, true
+}
+
+// listWorkflowRuns returns the runs of the workflows of the target that match
+// the given options. If the target has multiple workflows, their runs are
+// merged, newest first.
+func (s *Server) listWorkflowRuns(w http.ResponseWriter, r *http.Request, logCtx *log.Entry, targetID string, target *Target, client *github.Client, listOpts *github.ListWorkflowRunsOptions) ([]*github.WorkflowRun, bool) {
+	var runs []*github.WorkflowRun
+	for _, filename := range target.Filenames {
+		var wfRes *github.WorkflowRuns
+		var ghRes *github.Response
+		err := withRetry(r.Context(), logCtx, s.GithubMaxAttempts, func() (*github.Response, error) {
+			var err error
+			wfRes, ghRes, err = client.Actions.ListWorkflowRunsByFileName(r.Context(), target.Owner, target.Repo, filename, listOpts)
+			observeAPICall(targetID, "list_workflow_runs", err)
+			return ghRes, err
+		})
+		if err != nil {
+			writeGithubError(w, r, logCtx.WithField("workflow", filename), ghRes, err, "unable to obtain workflow runs")
+			return nil, false
+		}
+
+		logCtx.WithFields(log.Fields{
+			"workflow": filename,
+			"amount":   len(wfRes.WorkflowRuns),
+		}).Info("retrieved workflow runs")
+
+		runs = append(runs, wfRes.WorkflowRuns...)
+	}
+
+	if len(target.Filenames) > 1 {
+		sort.SliceStable(runs, func(i, j int) bool {
+			return runs[i].GetCreatedAt().After(runs[j].GetCreatedAt().Time)
+		})
+	}
+
+	return runs, true
+}
+
+// fetchPinnedArtifact retrieves the artifact that the target is pinned to from
+// the GitHub API, and returns it as the only artifact of its workflow run.
+func (s *Server) fetchPinnedArtifact(w http.ResponseWriter, r *http.Request, logCtx *log.Entry, targetID string, target *Target, client *github.Client) (*Run, bool) {
+	var artifact *github.Artifact
+	var ghRes *github.Response
+	err := withRetry(r.Context(), logCtx, s.GithubMaxAttempts, func() (*github.Response, error) {
+		var err error
+		artifact, ghRes, err = client.Actions.GetArtifact(r.Context(), target.Owner, target.Repo, *target.ArtifactID)
+		observeAPICall(targetID, "get_artifact", err)
+		return ghRes, err
+	})
+	if err != nil {
+		writeGithubError(w, r, logCtx, ghRes, err, "unable to obtain pinned artifact")
+		return nil, false
+	}
+
+	logCtx.WithField("id", *target.ArtifactID).Info("retrieved pinned artifact")
+
+	return &Run{
+		ID:        artifact.GetWorkflowRun().GetID(),
+		Artifacts: []*github.Artifact{artifact},
+		FetchTime: time.Now(),
+	}, true
+}
+
+// listRunArtifacts returns all artifacts of the given workflow run, which may
+// span multiple pages.
+func (s *Server) listRunArtifacts(w http.ResponseWriter, r *http.Request, logCtx *log.Entry, targetID string, target *Target, client *github.Client, runID int64) ([]*github.Artifact, bool) {
+	var artifacts []*github.Artifact
+	listOpts := github.ListOptions{PerPage: artifactsPageSize}
+	for {
+		var afRes *github.ArtifactList
+		var ghRes *github.Response
+		err := withRetry(r.Context(), logCtx, s.GithubMaxAttempts, func() (*github.Response, error) {
+			var err error
+			afRes, ghRes, err = client.Actions.ListWorkflowRunArtifacts(r.Context(), target.Owner, target.Repo, runID, &listOpts)
+			observeAPICall(targetID, "list_workflow_run_artifacts", err)
+			return ghRes, err
+		})
+		if err != nil {
+			writeGithubError(w, r, logCtx, ghRes, err, "unable to obtain artifact list")
+			return nil, false
+		}
+
+		artifacts = append(artifacts, afRes.Artifacts...)
+		if ghRes.NextPage == 0 {
+			break
+		}
+		listOpts.Page = ghRes.NextPage
+	}
+
+	logCtx.WithFields(log.Fields{
+		"workflow": target.Filenames,
+		"amount":   len(artifacts),
+	}).Info("retrieved workflow artifacts")
+
+	return artifacts, true
+}
+
+// filterRunsByConclusion returns the workflow runs that finished with the given
+// conclusion, preserving their order.
+func filterRunsByConclusion(runs []*github.WorkflowRun, conclusion string) []*github.WorkflowRun {
+	var res []*github.WorkflowRun
+	for _, run := range runs {
+		if run.GetConclusion() == conclusion {
+			res = append(res, run)
+		}
+	}
+	return res
+}
+
+// findArtifact returns the artifact that matches the given name. An artifact
+// with that exact name always takes precedence. Otherwise, the name is
+// interpreted as the index of the artifact in the list or as a glob pattern.
+// If multiple artifacts match the name or a glob pattern, the most recent one
+// is picked.
+// If caseInsensitive is set, names are matched regardless of case, but an
+// artifact with the exact same case still takes precedence.
+func findArtifact(artifacts []*github.Artifact, name string, caseInsensitive bool) *github.Artifact {
+	// Multiple jobs of a workflow run can upload artifacts with the same name
+	var exact *github.Artifact
+	for _, af := range artifacts {
+		if af.GetName() == name && (exact == nil || isNewerArtifact(af, exact)) {
+			exact = af
+		}
+	}
+	if exact != nil {
+		return exact
+	}
+
+	if caseInsensitive {
+		var match *github.Artifact
+		for _, af := range artifacts {
+			if !strings.EqualFold(af.GetName(), name) {
+				continue
+			}
+			if match == nil || isNewerArtifact(af, match) {
+				match = af
+			}
+		}
+		if match != nil {
+			return match
+		}
+	}
+
+	if index, err := strconv.Atoi(name); err == nil {
+		if index >= 0 && index < len(artifacts) {
+			return artifacts[index]
+		}
+		return nil
+	}
+
+	pattern := name
+	if caseInsensitive {
+		pattern = strings.ToLower(pattern)
+	}
+
+	var match *github.Artifact
+	for _, af := range artifacts {
+		afName := af.GetName()
+		if caseInsensitive {
+			afName = strings.ToLower(afName)
+		}
+		if ok, err := path.Match(pattern, afName); err != nil || !ok {
+			continue
+		}
+		if match == nil || isNewerArtifact(af, match) {
+			match = af
+		}
+	}
+
+	return match
+}
+
+// isNewerArtifact reports whether artifact a was created after artifact b.
+// Artifacts that were created at the same time are ordered by their ID, so that
+// the outcome doesn't depend on the order in which GitHub lists them.
+func isNewerArtifact(a *github.Artifact, b *github.Artifact) bool {
+	aCreated, bCreated := a.GetCreatedAt().Time, b.GetCreatedAt().Time
+	if !aCreated.Equal(bCreated) {
+		return aCreated.After(bCreated)
+	}
+	return a.GetID() > b.GetID()
+}
+
+// filterAttemptArtifacts returns the artifacts that were created during the
+// given workflow run attempt. The GitHub API lists the artifacts of all
+// attempts of a workflow run together, so they're told apart by the time at
+// which they were created.
+func filterAttemptArtifacts(artifacts []*github.Artifact, attempt *github.WorkflowRun) []*github.Artifact {
+	var res []*github.Artifact
+	for _, af := range artifacts {
+		createdAt := af.GetCreatedAt().Time
+		if createdAt.Before(attempt.GetRunStartedAt().Time) {
+			continue
+		}
+		if attempt.GetStatus() == "completed" && createdAt.After(attempt.GetUpdatedAt().Time) {
+			continue
+		}
+		res = append(res, af)
+	}
+	return res
+}
+
+// parseRunAttempt returns the workflow run attempt that was requested through
+// the "attempt" query parameter, or 0 if none was requested.
+func parseRunAttempt(r *http.Request) (int, error) {
+	attemptStr := r.URL.Query().Get("attempt")
+	if attemptStr == "" {
+		return 0, nil
+	}
+
+	attempt, err := strconv.Atoi(attemptStr)
+	if err != nil || attempt < 1 {
+		return 0, fmt.Errorf("invalid attempt: '%s'", attemptStr)
+	}
+
+	return attempt, nil
+}
+
+// isCommitSHA reports whether the given run name looks like a (possibly
+// abbreviated) commit SHA. Abbreviated SHAs that consist of only digits are
+// indistinguishable from workflow run IDs, so those are treated as the latter.
+func isCommitSHA(runName string) bool {
+	if !commitSHARegex.MatchString(runName) {
+		return false
+	}
+
+	return len(runName) == 40 || strings.ContainsAny(runName, "abcdef")
+}
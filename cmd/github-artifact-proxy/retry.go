@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"time"
+
+	"github.com/google/go-github/v60/github"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	retryBaseDelay = 500 * time.Millisecond
+	retryMaxDelay  = 10 * time.Second
+)
+
+// withRetry calls fn until it succeeds, fails with an error that is not worth
+// retrying or maxAttempts is reached. Only network errors and 5xx responses
+// from GitHub are retried, with exponential backoff and jitter in between
+// attempts.
+func withRetry(ctx context.Context, logCtx *log.Entry, maxAttempts int, fn func() (*github.Response, error)) error {
+	for attempt := 1; ; attempt++ {
+		res, err := fn()
+		if err == nil || attempt >= maxAttempts || !isRetryable(ctx, res, err) {
+			return err
+		}
+
+		delay := getRetryDelay(attempt)
+		logCtx.WithError(err).WithFields(log.Fields{
+			"attempt": attempt,
+			"delay":   delay,
+		}).Warn("github api call failed, retrying")
+
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return err
+		}
+	}
+}
+
+// isRetryable reports whether the failed API call with the given response and
+// error is worth retrying. Calls that were canceled or timed out are never
+// retried, even if it was the context of a single call that's done.
+func isRetryable(ctx context.Context, res *github.Response, err error) bool {
+	if ctx.Err() != nil || errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+
+	// go-github doesn't return a response for network errors
+	if res == nil || res.Response == nil {
+		return true
+	}
+
+	return res.StatusCode >= 500
+}
+
+// getRetryDelay returns the delay before the given attempt is retried, using
+// exponential backoff with jitter.
+func getRetryDelay(attempt int) time.Duration {
+	delay := retryBaseDelay << (attempt - 1)
+	if delay <= 0 || delay > retryMaxDelay {
+		delay = retryMaxDelay
+	}
+
+	return delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// runCache caches the workflow runs of a target by run name. The resolution of
+// a run is serialized per run name, so that concurrent requests for the same
+// run don't all hit the GitHub API, while requests for other runs aren't held
+// up. The listings of the recent runs of the target are cached as well.
+type runCache struct {
+	m     sync.Mutex
+	runs  map[string]*Run
+	lists map[string]*RunList
+	locks keyedLock[string]
+}
+
+// RunList is a page of the listing of the recent workflow runs of a target.
+type RunList struct {
+	Runs      []*runInfo
+	FetchTime time.Time
+}
+
+func newRunCache() *runCache {
+	return &runCache{
+		runs:  make(map[string]*Run),
+		lists: make(map[string]*RunList),
+	}
+}
+
+// Lock acquires the resolution lock of the run with the given name.
+func (c *runCache) Lock(ctx context.Context, name string) error {
+	return c.locks.Lock(ctx, name)
+}
+
+// TryLock acquires the resolution lock of the run with the given name if
+// that's possible without waiting, and reports whether it did.
+func (c *runCache) TryLock(name string) bool {
+	return c.locks.TryLock(name)
+}
+
+// Unlock releases the resolution lock of the run with the given name.
+func (c *runCache) Unlock(name string) {
+	c.locks.Unlock(name)
+}
+
+func (c *runCache) Get(name string) (*Run, bool) {
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	run, ok := c.runs[name]
+	return run, ok
+}
+
+func (c *runCache) Set(name string, run *Run) {
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	c.runs[name] = run
+}
+
+// Runs returns a copy of all cached runs by name.
+func (c *runCache) Runs() map[string]*Run {
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	runs := make(map[string]*Run, len(c.runs))
+	for name, run := range c.runs {
+		runs[name] = run
+	}
+	return runs
+}
+
+func (c *runCache) GetList(key string) (*RunList, bool) {
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	list, ok := c.lists[key]
+	return list, ok
+}
+
+func (c *runCache) SetList(key string, list *RunList) {
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	c.lists[key] = list
+}
+
+// ClearLists removes all cached listings of runs, e.g. because a new run
+// completed.
+func (c *runCache) ClearLists() {
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	clear(c.lists)
+}
+
+// DeleteFunc removes the runs for which the given function returns true and
+// returns them by name.
+func (c *runCache) DeleteFunc(fn func(name string, run *Run) bool) map[string]*Run {
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	deleted := make(map[string]*Run)
+	for name, run := range c.runs {
+		if fn(name, run) {
+			deleted[name] = run
+			delete(c.runs, name)
+		}
+	}
+	return deleted
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	s3DateFormat      = "20060102T150405Z"
+	s3UnsignedPayload = "UNSIGNED-PAYLOAD"
+	// s3EmptyPayloadHash is the SHA-256 hash of an empty request body
+	s3EmptyPayloadHash = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+)
+
+// S3Store is an ArtifactStore that keeps the ZIP files of artifacts in an S3
+// bucket. Any S3 compatible object storage service that supports path-style
+// requests and AWS Signature Version 4 can be used.
+type S3Store struct {
+	// Endpoint is the base URL of the S3 API, e.g. https://s3.eu-west-1.amazonaws.com
+	Endpoint *url.URL
+	Bucket   string
+	// Prefix is prepended to the object keys
+	Prefix          string
+	Region          string
+	AccessKeyID     string
+	SecretAccessKey string
+	SessionToken    string
+
+	client *http.Client
+}
+
+// NewS3Store returns an S3Store for the given bucket. The credentials are
+// taken from the standard AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY and
+// AWS_SESSION_TOKEN environment variables. If endpoint is empty, the AWS S3
+// endpoint of the region is used.
+func NewS3Store(endpoint string, region string, bucket string, prefix string) (*S3Store, error) {
+	if endpoint == "" {
+		endpoint = fmt.Sprintf("https://s3.%s.amazonaws.com", region)
+	}
+	endpointURL, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("parse endpoint: %w", err)
+	}
+	if endpointURL.Scheme != "http" && endpointURL.Scheme != "https" {
+		return nil, fmt.Errorf("endpoint must be an http or https URL: %s", endpoint)
+	}
+
+	store := S3Store{
+		Endpoint:        endpointURL,
+		Bucket:          bucket,
+		Prefix:          prefix,
+		Region:          region,
+		AccessKeyID:     os.Getenv("AWS_ACCESS_KEY_ID"),
+		SecretAccessKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		SessionToken:    os.Getenv("AWS_SESSION_TOKEN"),
+		client:          new(http.Client),
+	}
+	if store.AccessKeyID == "" || store.SecretAccessKey == "" {
+		return nil, fmt.Errorf("AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY must be set")
+	}
+
+	return &store, nil
+}
+
+func (s *S3Store) Get(ctx context.Context, artifactKey string) (io.ReadCloser, error) {
+	req, err := s.newRequest(ctx, http.MethodGet, artifactKey, nil)
+	if err != nil {
+		return nil, err
+	}
+	s.sign(req, s3EmptyPayloadHash, time.Now())
+
+	res, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	switch res.StatusCode {
+	case http.StatusOK:
+		return res.Body, nil
+	case http.StatusNotFound:
+		res.Body.Close()
+		return nil, errArtifactNotStored
+	default:
+		defer res.Body.Close()
+		return nil, readS3Error(res)
+	}
+}
+
+func (s *S3Store) Put(ctx context.Context, artifactKey string, file *os.File) error {
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+
+	req, err := s.newRequest(ctx, http.MethodPut, artifactKey, io.NewSectionReader(file, 0, info.Size()))
+	if err != nil {
+		return err
+	}
+	req.ContentLength = info.Size()
+	req.Header.Set("Content-Type", "application/zip")
+	s.sign(req, s3UnsignedPayload, time.Now())
+
+	res, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return readS3Error(res)
+	}
+	return nil
+}
+
+func (s *S3Store) newRequest(ctx context.Context, method string, artifactKey string, body io.Reader) (*http.Request, error) {
+	u := *s.Endpoint
+	u.Path = path.Join("/", u.Path, s.Bucket, s.Prefix, artifactKey+".zip")
+	return http.NewRequestWithContext(ctx, method, u.String(), body)
+}
+
+// sign adds an AWS Signature Version 4 to the given request. All headers that
+// are set on the request at this point are signed.
+func (s *S3Store) sign(req *http.Request, payloadHash string, now time.Time) {
+	amzDate := now.UTC().Format(s3DateFormat)
+	scope := fmt.Sprintf("%s/%s/s3/aws4_request", amzDate[:8], s.Region)
+
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	if s.SessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", s.SessionToken)
+	}
+
+	headers := map[string]string{"host": req.URL.Host}
+	for name, values := range req.Header {
+		headers[strings.ToLower(name)] = strings.TrimSpace(strings.Join(values, ","))
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		fmt.Fprintf(&canonicalHeaders, "%s:%s\n", name, headers[name])
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.Query().Encode(),
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	stringToSign := strings.Join([]string{
+		"AWS4-HMAC-SHA256",
+		amzDate,
+		scope,
+		hashHex([]byte(canonicalRequest)),
+	}, "\n")
+
+	key := hmacSHA256([]byte("AWS4"+s.SecretAccessKey), amzDate[:8])
+	key = hmacSHA256(key, s.Region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s.AccessKeyID, scope, signedHeaders, signature))
+}
+
+func readS3Error(res *http.Response) error {
+	body, _ := io.ReadAll(io.LimitReader(res.Body, 1024))
+	return fmt.Errorf("unexpected status code from s3: %d: %s", res.StatusCode, strings.TrimSpace(string(body)))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+func hashHex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
@@ -1,14 +1,21 @@
 package main
 
 import (
-	"archive/zip"
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"hash/fnv"
 	"io"
+	"io/fs"
+	"math"
+	"mime"
 	"net/http"
+	"net/url"
 	"os"
 	"path"
 	"path/filepath"
+	"reflect"
 	"strconv"
 	"strings"
 	"sync"
@@ -16,60 +23,320 @@ import (
 
 	"github.com/google/go-github/v60/github"
 	"github.com/julienschmidt/httprouter"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	log "github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
 	"golang.org/x/oauth2"
+	"golang.org/x/sync/semaphore"
+	"golang.org/x/sync/singleflight"
 )
 
 const (
-	targetLockTimeout = 30 * time.Second
+	runLockTimeout = 30 * time.Second
+	// singleFileName can be passed as the file name to get the only file of an
+	// artifact, without knowing its name
+	singleFileName = "_single"
+	// defaultIndexFile is the file that is served for directories, which is
+	// the only one that the file server of the standard library looks for
+	defaultIndexFile = "index.html"
 )
 
 type Server struct {
 	*ServerConfig
 	router *httprouter.Router
 
-	m        sync.Mutex
-	clients  map[*Target]*github.Client
-	dlClient *http.Client
+	m            sync.Mutex
+	refreshMutex sync.Mutex
+	clients      map[*Target]*github.Client
+	dlClient     *http.Client
+	cache        *diskCache
+	// artifactLocks protects the extracted artifacts in the download
+	// directory from being deleted while they're being extracted
+	artifactLocks keyedLock[string]
+	// artifactServeLocks protects the extracted artifacts in the download
+	// directory from being evicted while they're being served
+	artifactServeLocks keyedRWLock[string]
+	// releaseAssetLocks does the same for the downloaded release assets
+	releaseAssetLocks keyedLock[string]
+	downloads         singleflight.Group
+	// activeDownloads tracks the waiters of the downloads in the downloads
+	// group, by the same key
+	activeDownloads      map[string]*activeDownload
+	activeDownloadsMutex sync.Mutex
+	// downloadURLs caches the signed download URLs of artifacts by key
+	downloadURLs      map[string]*cachedDownloadURL
+	downloadURLsMutex sync.Mutex
+	// downloadSlots limits the number of concurrent artifact downloads. It's
+	// nil if there's no limit.
+	downloadSlots *semaphore.Weighted
+	// memCache holds the artifacts if they're kept in memory instead of in
+	// the download directory. It's nil otherwise.
+	memCache *memCache
+	// clientLimiter limits the rate of requests per client. It's nil if
+	// there's no limit.
+	clientLimiter *clientLimiter
+	// checksums holds the checksums of artifact files that were requested
+	// before.
+	checksums *checksumCache
+	// dynamicTargets holds the targets that were created for the requests of
+	// the dynamic mode, by ID.
+	dynamicTargets map[string]*Target
 }
 
 type ServerConfig struct {
-	Config         *Config
-	BasePath       string
-	DownloadDir    string
-	GithubCacheTTL time.Duration
+	Config            *Config
+	BasePath          string
+	DownloadDir       string
+	GithubCacheTTL    time.Duration
+	GithubMaxAttempts int
+	GithubTimeout     time.Duration
+	// StaleWhileRevalidate enables serving expired workflow runs from the
+	// cache while they're refreshed in the background.
+	StaleWhileRevalidate bool
+	// DownloadTimeout is the deadline for downloading an artifact ZIP file,
+	// including reading the response body. Zero means no deadline.
+	DownloadTimeout time.Duration
+	// DownloadMaxAttempts is the maximum number of times an artifact ZIP file
+	// is downloaded if it turns out to be truncated or corrupt.
+	DownloadMaxAttempts int
+	// RequestTimeout is the deadline for resolving and fetching the artifact
+	// of a target request. Downloads that are shared with other requests
+	// carry on after it. Zero means no deadline.
+	RequestTimeout time.Duration
+	// MaxDownloads is the maximum number of artifacts that are downloaded and
+	// extracted at the same time. Zero means no limit.
+	MaxDownloads int
+	// MaxArtifactSize is the maximum size of an artifact that the proxy
+	// downloads, as reported by GitHub. Zero means no limit.
+	MaxArtifactSize int64
+	MetricsPath     string
+	CacheMaxSize    int64
+	// MemoryCacheSize is the maximum size of the artifacts that are kept in
+	// memory. If it's set, nothing is written to disk and DownloadDir is
+	// ignored.
+	MemoryCacheSize int64
+	UnzipLimits     UnzipLimits
+	// UnzipSingleFile enables extracting only the requested file of an
+	// artifact. Artifacts are still extracted fully if a directory is
+	// requested.
+	UnzipSingleFile bool
+	// Store is consulted for the ZIP file of an artifact before downloading it
+	// from GitHub. It's nil if no artifact store is configured.
+	Store ArtifactStore
+	// Compress enables compressing text-based responses with gzip or brotli
+	// for clients that support it.
+	Compress    bool
+	HealthPaths HealthPaths
+	// LandingPage enables an HTML page at the base path that lists the
+	// configured targets.
+	LandingPage bool
+	// ReadinessCheckGithub enables an authenticated GitHub API call per token
+	// in the readiness check.
+	ReadinessCheckGithub bool
+	// TrustForwarded enables honoring the X-Forwarded-Proto,
+	// X-Forwarded-Host and X-Forwarded-Prefix headers of a reverse proxy when
+	// building redirect URLs, and the X-Forwarded-For header when determining
+	// the IP address of a client.
+	TrustForwarded bool
+	// ServeInline enables serving the files of artifacts directly for all
+	// targets, instead of redirecting clients to the file server. Some
+	// clients don't follow redirects.
+	ServeInline bool
+	// DisableListings disables the listings of the files in artifacts, both
+	// the directory listings of the file server and the JSON listings.
+	// Directories are only served if they contain an index file.
+	DisableListings bool
+	// IndexFile is the name of the file that is served for directories of
+	// artifacts instead of a listing. It defaults to index.html.
+	IndexFile string
+	// InlineUserAgents are the User-Agent prefixes of clients that are known
+	// not to follow redirects. The files of artifacts are served directly to
+	// them, like with ServeInline.
+	InlineUserAgents []string
+	// PrefetchInterval is the interval at which the artifacts of the latest
+	// workflow runs are prefetched, if they're prefetched at all. Zero means
+	// that they're only prefetched on startup.
+	PrefetchInterval time.Duration
+	// TempDir is the directory that artifact ZIP files are downloaded to
+	// before they're extracted. It defaults to a subdirectory of DownloadDir,
+	// so that large downloads don't end up on a small tmpfs.
+	TempDir string
+	// ClientRateLimit is the maximum number of requests per minute per client
+	// IP address. Zero means no limit. ClientRateLimitBurst is the amount of
+	// requests that a client can make at once, which defaults to
+	// ClientRateLimit.
+	ClientRateLimit      int
+	ClientRateLimitBurst int
+	// ArtifactMaxAge is the duration that the responses of the file server
+	// can be cached for. As the contents of an artifact never change, they're
+	// marked as immutable. Zero means that clients have to revalidate them on
+	// every request.
+	ArtifactMaxAge time.Duration
+	// PersistRuns enables persisting the cached workflow runs to the download
+	// directory, so that they survive restarts.
+	PersistRuns bool
 }
 
-func NewServer(cfg *ServerConfig) *Server {
+type HealthPaths struct {
+	Liveness  string
+	Readiness string
+	// SkipBasePath registers the health check paths without the base path
+	// prefix.
+	SkipBasePath bool
+}
+
+func NewServer(cfg *ServerConfig) (*Server, error) {
 	if !strings.HasPrefix(cfg.BasePath, "/") {
 		cfg.BasePath = "/" + cfg.BasePath
 	}
+
+	if cfg.IndexFile == "" {
+		cfg.IndexFile = defaultIndexFile
+	}
+	if strings.ContainsAny(cfg.IndexFile, `/\`) || cfg.IndexFile == "." || cfg.IndexFile == ".." {
+		return nil, fmt.Errorf("invalid index file name: %s", cfg.IndexFile)
+	}
+
+	if cfg.MemoryCacheSize <= 0 {
+		dlDir, err := prepareDownloadDir(cfg.DownloadDir)
+		if err != nil {
+			return nil, fmt.Errorf("download dir: %w", err)
+		}
+		cfg.DownloadDir = dlDir
+
+		if cfg.TempDir == "" {
+			cfg.TempDir = filepath.Join(dlDir, "tmp")
+		}
+		if err := os.MkdirAll(cfg.TempDir, os.ModePerm); err != nil {
+			return nil, fmt.Errorf("temp dir: %w", err)
+		}
+	}
 	s := Server{
 		ServerConfig: cfg,
 		clients:      make(map[*Target]*github.Client),
-		dlClient:     &http.Client{Timeout: 10 * time.Second},
+		dlClient:     new(http.Client),
+		checksums:    newChecksumCache(),
+
+		dynamicTargets: make(map[string]*Target),
+	}
+
+	if s.ClientRateLimit > 0 {
+		s.clientLimiter = newClientLimiter(s.ClientRateLimit, s.ClientRateLimitBurst)
+	}
+
+	if s.MaxDownloads > 0 {
+		s.downloadSlots = semaphore.NewWeighted(int64(s.MaxDownloads))
+	}
+
+	if s.MemoryCacheSize > 0 {
+		s.memCache = newMemCache(s.MemoryCacheSize)
+	} else {
+		if err := sweepIncompleteArtifacts(filepath.Join(s.DownloadDir, "artifacts")); err != nil {
+			return nil, fmt.Errorf("sweep incomplete artifacts: %w", err)
+		}
+		if err := sweepIncompleteArtifacts(filepath.Join(s.DownloadDir, "releases")); err != nil {
+			return nil, fmt.Errorf("sweep incomplete release assets: %w", err)
+		}
+		if err := sweepTempZipFiles(s.TempDir); err != nil {
+			return nil, fmt.Errorf("sweep temporary zip files: %w", err)
+		}
+	}
+
+	if s.PersistRuns && s.memCache == nil {
+		if err := s.loadRuns(); err != nil {
+			log.WithError(err).Warn("unable to restore cached workflow runs")
+		}
+	}
+
+	if s.CacheMaxSize > 0 && s.memCache == nil {
+		cache, err := newDiskCache(filepath.Join(s.DownloadDir, "artifacts"), s.CacheMaxSize)
+		if err != nil {
+			return nil, fmt.Errorf("index artifact cache: %w", err)
+		}
+		s.cache = cache
 	}
 
 	r := httprouter.New()
+	r.NotFound = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		httpError(w, r, http.StatusNotFound)
+	})
+	r.MethodNotAllowed = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		httpError(w, r, http.StatusMethodNotAllowed)
+	})
 
-	fs := s.getFileServer(s.DownloadDir)
-	r.GET(s.buildURLPath("/artifacts/*filename"), fs)
+	// Artifacts in memory are always served inline
+	if s.memCache == nil {
+		r.GET(s.buildURLPath("/artifacts/*filename"), s.getFileServer(s.DownloadDir))
+	}
+	r.GET(s.buildURLPath("/targets"), s.handleTargetsRequest)
+	r.GET(s.buildURLPath("/version"), s.handleVersionRequest)
+	r.POST(s.buildURLPath("/targets/:target/purge"), s.handlePurgeRequest)
+	r.GET(s.buildURLPath("/targets/:target/runs"), s.handleRunsRequest)
+	r.GET(s.buildURLPath("/targets/:target/runs/:run/artifacts/:artifact"), s.handleArtifactRequest)
 	r.GET(s.buildURLPath("/targets/:target/runs/:run/artifacts/:artifact/*filename"), s.handleTargetRequest)
+	r.GET(s.buildURLPath("/targets/:target/artifacts/:artifact"), withLatestRun(s.handleArtifactRequest))
+	r.GET(s.buildURLPath("/targets/:target/artifacts/:artifact/*filename"), withLatestRun(s.handleTargetRequest))
+	r.GET(s.buildURLPath("/gh/:owner/:repo/:workflow/runs/:run/artifacts/:artifact"), s.withDynamicTarget(s.handleArtifactRequest))
+	r.GET(s.buildURLPath("/gh/:owner/:repo/:workflow/runs/:run/artifacts/:artifact/*filename"), s.withDynamicTarget(s.handleTargetRequest))
+	r.GET(s.buildURLPath("/gh/:owner/:repo/:workflow/artifacts/:artifact"), s.withDynamicTarget(withLatestRun(s.handleArtifactRequest)))
+	r.GET(s.buildURLPath("/gh/:owner/:repo/:workflow/artifacts/:artifact/*filename"), s.withDynamicTarget(withLatestRun(s.handleTargetRequest)))
+	if s.LandingPage {
+		r.GET(s.buildURLPath("/"), s.handleLandingPageRequest)
+	}
+	if s.Config.Webhook != nil {
+		r.POST(s.buildURLPath(s.Config.Webhook.Path), s.handleWebhook)
+	}
+	if s.HealthPaths.Liveness != "" {
+		r.GET(s.buildHealthURLPath(s.HealthPaths.Liveness), s.handleLivenessRequest)
+	}
+	if s.HealthPaths.Readiness != "" {
+		r.GET(s.buildHealthURLPath(s.HealthPaths.Readiness), s.handleReadinessRequest)
+	}
+	if s.MetricsPath != "" {
+		r.Handler(http.MethodGet, s.buildURLPath(s.MetricsPath), promhttp.Handler())
+	}
 
 	s.router = r
-	return &s
+	return &s, nil
 }
 
 func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	r = withRequestID(w, r)
+	w, logAccess := s.withAccessLog(w, r)
+	defer logAccess()
+	if s.handleCORS(w, r) {
+		return
+	}
+	if !s.checkClientRateLimit(w, r) {
+		return
+	}
+	if !s.checkAuth(w, r) {
+		return
+	}
+	if s.Compress {
+		var done func()
+		w, done = withCompression(w, r)
+		defer done()
+	}
 	s.router.ServeHTTP(w, r)
 }
 
+// withLatestRun wraps the given handler so that it can be registered on a
+// route without a run parameter. The request is handled as if "latest" was
+// passed as the run.
+func withLatestRun(h httprouter.Handle) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+		h(w, r, append(params, httprouter.Param{Key: "run", Value: "latest"}))
+	}
+}
+
 func (s *Server) handleTargetRequest(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
 	targetId := params.ByName("target")
 	runName := params.ByName("run")
 	artifactName := params.ByName("artifact")
 	filename := strings.TrimPrefix(params.ByName("filename"), "/")
-	logCtx := log.WithFields(log.Fields{
+	logCtx := requestLogger(r.Context()).WithFields(log.Fields{
 		"addr":     r.RemoteAddr,
 		"path":     r.URL.Path,
 		"target":   targetId,
@@ -79,225 +346,455 @@ func (s *Server) handleTargetRequest(w http.ResponseWriter, r *http.Request, par
 	})
 	logCtx.Info("handling request")
 
+	r, span := startRequestSpan(r, "handleTargetRequest",
+		attribute.String("target", targetId),
+		attribute.String("run", runName),
+		attribute.String("artifact", artifactName),
+		attribute.String("filename", filename),
+	)
+	defer span.End()
+
+	if s.RequestTimeout > 0 {
+		ctx, cancel := context.WithTimeout(r.Context(), s.RequestTimeout)
+		defer cancel()
+		r = r.WithContext(ctx)
+	}
+
 	target, ok := s.getTarget(targetId)
 	if !ok {
 		logCtx.Warn("target not found")
-		httpError(w, http.StatusNotFound)
+		httpError(w, r, http.StatusNotFound)
 		return
 	}
 
-	lockCtx, cancel := context.WithTimeout(r.Context(), targetLockTimeout)
-	defer cancel()
-	if err := target.Lock(lockCtx); err != nil {
-		logCtx.WithError(err).WithField("timeout", targetLockTimeout).Error("unable to acquire target lock")
-		httpError(w, http.StatusNotFound)
+	if !authorizeTarget(w, r, logCtx, target) {
 		return
 	}
-	defer target.Unlock()
+	writeTargetHeaders(w, target)
 
-	client := s.getClient(target)
+	// Release assets are single files, which are served without the trailing
+	// slash
+	if target.isRelease() {
+		if filename != "" {
+			logCtx.Warn("release assets don't contain files")
+			httpError(w, r, http.StatusNotFound)
+			return
+		}
+		http.Redirect(w, r, s.buildRedirectURL(r, strings.TrimSuffix(r.URL.Path, "/")), http.StatusMovedPermanently)
+		return
+	}
 
-	var cachedRun *Run
-	if cachedRun, ok = target.runCache[runName]; !ok || time.Since(target.runCache[runName].FetchTime) > s.GithubCacheTTL {
-		var run *github.WorkflowRun
-		if runName == "latest" {
-			listOpts := github.ListWorkflowRunsOptions{}
-			if target.LatestFilter != nil {
-				if target.LatestFilter.Branch != nil {
-					listOpts.Branch = *target.LatestFilter.Branch
-				}
-				if target.LatestFilter.Event != nil {
-					listOpts.Event = *target.LatestFilter.Event
-				}
-				if target.LatestFilter.Status != nil {
-					listOpts.Status = *target.LatestFilter.Status
-				}
-			}
+	outcome := outcomeError
+	defer func() {
+		requestsTotal.WithLabelValues(targetId, outcome).Inc()
+		span.SetAttributes(attribute.String("outcome", outcome))
+		if outcome == outcomeError {
+			span.SetStatus(codes.Error, "")
+		}
+	}()
 
-			wfRes, ghRes, err := client.Actions.ListWorkflowRunsByFileName(r.Context(), target.Owner, target.Repo, target.Filename, &listOpts)
-			if err != nil {
-				if ghRes != nil && ghRes.StatusCode == http.StatusNotFound {
-					logCtx.WithError(err).Warn("unable to obtain workflow runs")
-					httpError(w, http.StatusNotFound)
-					return
-				}
+	client, ok := s.getRequestClient(w, r, logCtx, target)
+	if !ok {
+		return
+	}
 
-				logCtx.WithError(err).Error("unable to obtain workflow runs")
-				httpError(w, http.StatusInternalServerError)
-				return
-			}
+	artifact, ok := s.resolveArtifact(w, r, logCtx, targetId, target, client, runName, artifactName)
+	if !ok {
+		return
+	}
+	if !s.checkArtifactSize(w, r, logCtx, target, artifact) {
+		return
+	}
 
-			logCtx.WithFields(log.Fields{
-				"workflow": target.Filename,
-				"amount":   len(wfRes.WorkflowRuns),
-			}).Info("retrieved workflow runs")
+	// Finding the only file of the artifact requires the whole artifact to be
+	// extracted
+	single := filename == singleFileName
+	if single {
+		filename = ""
+	}
 
-			if len(wfRes.WorkflowRuns) == 0 {
-				logCtx.Warn("list of workflow runs is empty")
-				httpError(w, http.StatusNotFound)
-				return
-			}
+	if s.memCache != nil {
+		outcome = s.serveMemoryArtifact(w, r, logCtx, targetId, target, client, artifact, filename, single)
+		return
+	}
 
-			// We assume that the first workflow run in the list is the latest one. Luckily this
-			// appears to always be the case, because there seems to be no way to specify
-			// a sorting preference.
-			run = wfRes.WorkflowRuns[0]
-		} else {
-			runID, err := strconv.ParseInt(runName, 10, 64)
-			if err != nil {
-				logCtx.WithError(err).Warn("unable the parse run ID")
-				httpError(w, http.StatusBadRequest)
-				return
-			}
-			wfRun, ghRes, err := client.Actions.GetWorkflowRunByID(r.Context(), target.Owner, target.Repo, runID)
-			if err != nil {
-				if ghRes != nil && ghRes.StatusCode == http.StatusNotFound {
-					logCtx.WithError(err).Warn("unable to obtain workflow run")
-					httpError(w, http.StatusNotFound)
-					return
-				}
+	artifactKey := target.getArtifactKey(*artifact.ID)
+	dlDir := s.getArtifactCacheDir(artifactKey)
 
-				logCtx.WithError(err).Error("unable to obtain workflow run")
-				httpError(w, http.StatusInternalServerError)
-				return
-			}
+	// Keep the artifact from being evicted until it has been served
+	s.artifactServeLocks.RLock(artifactKey)
+	defer s.artifactServeLocks.RUnlock(artifactKey)
 
-			run = wfRun
+	if target.isProtected() {
+		// Mark the artifact as protected before it's extracted, so that it's
+		// never accessible through the unauthenticated file server
+		if err := markArtifactProtected(dlDir); err != nil {
+			logCtx.WithError(err).Error("unable to mark artifact as protected")
+			httpError(w, r, http.StatusInternalServerError)
+			return
 		}
+	}
 
-		afRes, _, err := client.Actions.ListWorkflowRunArtifacts(r.Context(), target.Owner, target.Repo, *run.ID, nil)
-		if err != nil {
-			logCtx.WithError(err).Error("unable to obtain artifact list")
-			httpError(w, http.StatusInternalServerError)
-			return
+	if isArtifactComplete(dlDir) || (s.UnzipSingleFile && isArtifactFileExtracted(dlDir, target.getArtifactPath(filename))) {
+		logCtx.Info("serving cached artifact")
+		if s.cache != nil {
+			s.cache.Touch(artifactKey)
 		}
 
-		logCtx.WithFields(log.Fields{
-			"workflow": target.Filename,
-			"amount":   len(afRes.Artifacts),
-		}).Info("retrieved workflow artifacts")
+		outcome = outcomeHit
+		s.serveTargetArtifact(w, r, logCtx, target, *artifact.ID, dlDir, filename, single)
+		return
+	}
 
-		cachedRun = &Run{
-			ID:        *run.ID,
-			Artifacts: afRes.Artifacts,
-			FetchTime: time.Now(),
-		}
-		target.runCache[runName] = cachedRun
+	// Artifacts that were extracted before they expired can still be served
+	// from the cache, but GitHub no longer allows downloading them
+	if artifact.GetExpired() {
+		writeArtifactExpired(w, r, logCtx, artifact)
+		return
+	}
+
+	err := s.fetchArtifact(r.Context(), logCtx, targetId, target, client, *artifact.ID, target.getArtifactPath(filename))
+	if errors.Is(err, errArtifactFileNotFound) && target.FallbackFile != "" {
+		// Only the fallback file has to be extracted if just the requested
+		// file would have been
+		err = s.fetchArtifact(r.Context(), logCtx, targetId, target, client, *artifact.ID, target.getArtifactPath(target.FallbackFile))
+	}
+	if err != nil {
+		s.writeFetchError(w, r, logCtx, err)
+		return
 	}
 
-	var artifact *github.Artifact
-	for _, af := range cachedRun.Artifacts {
-		if af.Name != nil && *af.Name == artifactName {
-			artifact = af
-			break
+	logCtx.Info("serving downloaded artifact")
+
+	outcome = outcomeMiss
+	writeCacheHeaders(w)
+	s.serveTargetArtifact(w, r, logCtx, target, *artifact.ID, dlDir, filename, single)
+}
+
+// handleArtifactRequest streams the raw artifact ZIP file straight from GitHub
+// to the client if the artifact name has a ".zip" suffix. Nothing is written to
+// the download directory. If JSON was requested, a manifest of the files in
+// the ZIP file is returned instead. Otherwise, the metadata of the artifact is
+// returned if JSON was requested, or the client is redirected to the root of
+// the artifact. Requests for release targets are handed off to
+// handleReleaseAssetRequest.
+func (s *Server) handleArtifactRequest(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	if target, ok := s.getTarget(params.ByName("target")); ok && target.isRelease() {
+		s.handleReleaseAssetRequest(w, r, params)
+		return
+	}
+
+	artifactName, isZip := strings.CutSuffix(params.ByName("artifact"), ".zip")
+	w.Header().Add("Vary", "Accept")
+	if !isZip {
+		if !requestsJSON(r) {
+			http.Redirect(w, r, s.buildRedirectURL(r, r.URL.Path+"/"), http.StatusMovedPermanently)
+			return
 		}
+		artifactName = params.ByName("artifact")
 	}
 
-	if artifact == nil || artifact.ID == nil {
-		logCtx.Warn("artifact not found")
-		httpError(w, http.StatusNotFound)
+	targetId := params.ByName("target")
+	runName := params.ByName("run")
+	logCtx := requestLogger(r.Context()).WithFields(log.Fields{
+		"addr":     r.RemoteAddr,
+		"path":     r.URL.Path,
+		"target":   targetId,
+		"artifact": artifactName,
+		"run":      runName,
+	})
+	isManifest := isZip && requestsJSON(r)
+	if isManifest && s.DisableListings {
+		logCtx.Warn("artifact listings are disabled")
+		httpError(w, r, http.StatusNotFound)
 		return
 	}
+	if isManifest {
+		logCtx.Info("handling zip manifest request")
+	} else if isZip {
+		logCtx.Info("handling zip request")
+	} else {
+		logCtx.Info("handling artifact metadata request")
+	}
 
-	logCtx.WithFields(log.Fields{
-		"id":         *artifact.ID,
-		"created_at": artifact.CreatedAt,
-	}).Info("found artifact")
+	target, ok := s.getTarget(targetId)
+	if !ok {
+		logCtx.Warn("target not found")
+		httpError(w, r, http.StatusNotFound)
+		return
+	}
 
-	dlDir := s.getArtifactCacheDir(*artifact.ID)
-	dlPath := s.buildURLPath(fmt.Sprintf("/artifacts/%d/%s", *artifact.ID, filename))
-	if _, err := os.Stat(dlDir); err == nil {
-		logCtx.WithFields(log.Fields{
-			"redirect_path": "dlPath",
-		}).Info("redirecting to cached artifact")
+	if !authorizeTarget(w, r, logCtx, target) {
+		return
+	}
+	writeTargetHeaders(w, target)
+
+	outcome := outcomeError
+	defer func() {
+		requestsTotal.WithLabelValues(targetId, outcome).Inc()
+	}()
+
+	client, ok := s.getRequestClient(w, r, logCtx, target)
+	if !ok {
+		return
+	}
 
-		http.Redirect(w, r, dlPath, http.StatusFound)
+	artifact, ok := s.resolveArtifact(w, r, logCtx, targetId, target, client, runName, artifactName)
+	if !ok {
 		return
 	}
 
-	logCtx.Info("preparing artifact download")
+	if !isZip {
+		outcome = outcomeHit
+		writeJSON(w, logCtx, http.StatusOK, newArtifactInfo(artifact))
+		return
+	}
 
-	url, _, err := client.Actions.DownloadArtifact(r.Context(), target.Owner, target.Repo, *artifact.ID, 3)
-	if err != nil {
-		logCtx.WithError(err).Error("unable to obtain artifact download url")
-		httpError(w, http.StatusInternalServerError)
+	if artifact.GetExpired() {
+		writeArtifactExpired(w, r, logCtx, artifact)
 		return
 	}
 
-	res, err := s.dlClient.Get(url.String())
+	// Only the central directory is downloaded for the manifest, so the size
+	// of the artifact doesn't matter
+	if isManifest {
+		if s.serveZipManifest(w, r, logCtx, targetId, target, client, *artifact.ID) {
+			outcome = outcomeMiss
+		}
+		return
+	}
+
+	if !s.checkArtifactSize(w, r, logCtx, target, artifact) {
+		return
+	}
+
+	dlCtx, dlCancel := s.withDownloadTimeout(r.Context())
+	defer dlCancel()
+	res, err := s.openArtifactZip(dlCtx, logCtx, targetId, target, client, *artifact.ID)
 	if err != nil {
-		logCtx.WithError(err).Error("unable to prepare artifact download http request")
-		httpError(w, http.StatusInternalServerError)
+		if errors.Is(err, errDownloadStatus) {
+			logCtx.WithError(err).Error("unable to download artifact zip")
+			httpError(w, r, http.StatusBadGateway)
+			return
+		}
+		writeGithubError(w, r, logCtx, nil, err, "unable to download artifact zip")
 		return
 	}
 	defer res.Body.Close()
 
-	tempZipFile, err := os.CreateTemp(os.TempDir(), fmt.Sprintf("gh-artifact-%d-*.zip", *artifact.ID))
+	logCtx.Info("streaming artifact zip")
+
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": artifactName + ".zip"}))
+	if res.ContentLength >= 0 {
+		w.Header().Set("Content-Length", strconv.FormatInt(res.ContentLength, 10))
+	}
+	writeCacheHeaders(w)
+
+	n, err := io.Copy(w, res.Body)
+	artifactDownloadBytesTotal.WithLabelValues(targetId).Add(float64(n))
 	if err != nil {
-		logCtx.WithError(err).Error("unable to create temporary file to download the artifact zip to")
-		httpError(w, http.StatusInternalServerError)
+		logCtx.WithError(err).Warn("unable to stream artifact zip")
 		return
 	}
-	defer deleteFile(logCtx, tempZipFile.Name())
 
-	logCtx.WithFields(log.Fields{
-		"temp_zip_filename": tempZipFile.Name(),
-	}).Info("downloading and extracting artifact zip")
+	outcome = outcomeMiss
+}
+
+// serveTargetArtifact serves the given file of an extracted artifact of the
+// given target. If single is set, the only file in the artifact is served
+// instead. If the target has a prefix to strip, the directory with that name
+// is treated as the root of the artifact.
+func (s *Server) serveTargetArtifact(w http.ResponseWriter, r *http.Request, logCtx *log.Entry, target *Target, artifactID int64, dlDir string, filename string, single bool) {
+	if target.StripPrefix != "" {
+		dlDir = filepath.Join(dlDir, filepath.FromSlash(target.StripPrefix))
+		if info, err := os.Stat(dlDir); err != nil || !info.IsDir() {
+			logCtx.WithField("strip_prefix", target.StripPrefix).Warn("prefix to strip not found in artifact")
+			httpError(w, r, http.StatusNotFound)
+			return
+		}
+	}
+
+	if single {
+		var ok bool
+		if filename, ok = findSingleFile(w, r, logCtx, os.DirFS(dlDir)); !ok {
+			return
+		}
+		logCtx = logCtx.WithField("single_file", filename)
+	}
 
-	if _, err := io.Copy(tempZipFile, res.Body); err != nil {
-		logCtx.WithError(err).Error("unable to download artifact zip")
-		httpError(w, http.StatusInternalServerError)
+	if requestsChecksum(r) {
+		s.serveChecksum(w, r, logCtx, target, artifactID, os.DirFS(dlDir), filename)
 		return
 	}
 
-	zipReader, err := zip.OpenReader(tempZipFile.Name())
-	if err != nil {
-		logCtx.WithError(err).Error("unable to open zip file")
-		httpError(w, http.StatusInternalServerError)
+	if fallback, ok := target.resolveFallbackFile(os.DirFS(dlDir), filename); ok {
+		s.serveFallbackFile(w, r, logCtx, artifactID, http.Dir(dlDir), fallback)
 		return
 	}
-	defer zipReader.Close()
 
-	// Before extracting the ZIP file, check if the requested file actually
-	// exists. Skip this check if we've requested the root directory.
-	if filename != "" {
-		file, err := zipReader.Open(filename)
-		if err != nil {
-			if os.IsNotExist(err) {
-				logCtx.WithError(err).Warn("unable to open file inside zip")
-				httpError(w, http.StatusNotFound)
-			} else {
-				logCtx.WithError(err).Error("unable to open file inside zip")
-				httpError(w, http.StatusInternalServerError)
-			}
+	dlPath := s.buildURLPath(fmt.Sprintf("/artifacts/%s/%s", target.getArtifactKey(artifactID), target.getArtifactPath(filename)))
+	s.serveArtifact(w, r, logCtx, artifactID, dlDir, dlPath, filename, s.shouldServeInline(w, r, target))
+}
+
+// shouldServeInline reports whether the requested file of an artifact must be
+// served directly instead of through a redirect to the file server. This is
+// always the case with -serve-inline and for targets that can't be served
+// through the file server. Otherwise, the inline query parameter decides if
+// it's passed (e.g. ?inline=1 or ?inline=0), and the User-Agent of the client
+// if it's not.
+func (s *Server) shouldServeInline(w http.ResponseWriter, r *http.Request, target *Target) bool {
+	if s.ServeInline || target.serveInline() {
+		return true
+	}
+
+	query := r.URL.Query()
+	if query.Has("inline") {
+		if value := query.Get("inline"); value == "" {
+			return true
+		} else if inline, err := strconv.ParseBool(value); err == nil {
+			return inline
+		}
+	}
+
+	if len(s.InlineUserAgents) == 0 {
+		return false
+	}
+	w.Header().Add("Vary", "User-Agent")
+	userAgent := strings.ToLower(r.UserAgent())
+	for _, prefix := range s.InlineUserAgents {
+		if strings.HasPrefix(userAgent, strings.ToLower(prefix)) {
+			return true
+		}
+	}
+	return false
+}
+
+// findSingleFile returns the path of the only file in the given extracted
+// artifact. If the artifact doesn't contain exactly one file, an error response
+// is written and false is returned.
+func findSingleFile(w http.ResponseWriter, r *http.Request, logCtx *log.Entry, fsys fs.FS) (string, bool) {
+	files, err := listArtifactFiles(fsys)
+	if err != nil {
+		logCtx.WithError(err).Error("unable to list artifact files")
+		httpError(w, r, http.StatusInternalServerError)
+		return "", false
+	}
+	if len(files) != 1 {
+		logCtx.WithField("amount", len(files)).Warn("artifact doesn't contain a single file")
+		httpErrorDetail(w, r, http.StatusConflict, fmt.Sprintf("the artifact contains %d files instead of a single one", len(files)))
+		return "", false
+	}
+	return files[0].Path, true
+}
+
+// serveArtifact redirects the client to the requested file of an extracted
+// artifact. Range requests are answered directly instead, because not every
+// client resends the Range header after following a redirect, which breaks
+// partial and resumable downloads. If inline is set, the file is always served
+// directly. Requests for the root of the artifact that ask for JSON get a
+// listing of the files in the artifact.
+func (s *Server) serveArtifact(w http.ResponseWriter, r *http.Request, logCtx *log.Entry, artifactID int64, dlDir string, dlPath string, filename string, inline bool) {
+	if filename == "" {
+		w.Header().Add("Vary", "Accept")
+		if requestsJSON(r) {
+			s.serveArtifactListing(w, r, logCtx, os.DirFS(dlDir))
 			return
 		}
-		file.Close()
 	}
 
-	if err := os.MkdirAll(dlDir, os.ModePerm); err != nil {
-		logCtx.WithError(err).Error("unable to create directory to unzip the artifact to")
-		httpError(w, http.StatusInternalServerError)
+	if inline {
+		s.serveArtifactInline(w, r, logCtx, artifactID, http.Dir(dlDir), filename)
 		return
 	}
 
-	if err := Unzip(zipReader, dlDir); err != nil {
-		logCtx.WithError(err).Error("unable to unzip artifact")
-		httpError(w, http.StatusInternalServerError)
+	if r.Header.Get("Range") == "" || filename == "" {
+		logCtx.WithFields(log.Fields{
+			"redirect_path": dlPath,
+		}).Info("redirecting to artifact")
 
-		deleteDir(logCtx, dlDir)
+		http.Redirect(w, r, s.buildRedirectURL(r, dlPath), http.StatusFound)
 		return
 	}
 
-	logCtx.WithFields(log.Fields{
-		"redirect_path": dlPath,
-	}).Info("redirecting to downloaded artifact")
+	file, err := os.Open(filepath.Join(dlDir, filepath.FromSlash(path.Clean("/"+filename))))
+	if err != nil {
+		if os.IsNotExist(err) {
+			logCtx.WithError(err).Warn("unable to open artifact file")
+			httpError(w, r, http.StatusNotFound)
+		} else {
+			logCtx.WithError(err).Error("unable to open artifact file")
+			httpError(w, r, http.StatusInternalServerError)
+		}
+		return
+	}
+	defer file.Close()
 
-	writeCacheHeaders(w)
-	http.Redirect(w, r, dlPath, http.StatusFound)
+	info, err := file.Stat()
+	if err != nil {
+		logCtx.WithError(err).Error("unable to stat artifact file")
+		httpError(w, r, http.StatusInternalServerError)
+		return
+	}
+
+	if info.IsDir() {
+		logCtx.WithFields(log.Fields{
+			"redirect_path": dlPath,
+		}).Info("redirecting to artifact directory")
+
+		http.Redirect(w, r, s.buildRedirectURL(r, dlPath), http.StatusFound)
+		return
+	}
+
+	logCtx.WithField("range", r.Header.Get("Range")).Info("serving artifact file range")
+	s.writeContentTypeHeaders(w, filename)
+	writeETag(w, artifactID, filename)
+	http.ServeContent(w, r, info.Name(), info.ModTime(), file)
 }
 
-func (s *Server) getClient(t *Target) *github.Client {
+// serveArtifactInline serves the requested file (or directory listing) of an
+// extracted artifact from the given file system without redirecting the client
+// to the file server.
+func (s *Server) serveArtifactInline(w http.ResponseWriter, r *http.Request, logCtx *log.Entry, artifactID int64, fsys http.FileSystem, filename string) {
+	logCtx.Info("serving artifact inline")
+
+	s.writeContentTypeHeaders(w, filename)
+	writeETag(w, artifactID, filename)
+
+	req := r.Clone(r.Context())
+	req.URL.Path = "/" + filename
+	req.URL.RawPath = ""
+	http.FileServer(s.getArtifactFileSystem(fsys)).ServeHTTP(w, req)
+}
+
+// serveFallbackFile serves the given fallback file of an extracted artifact
+// in place of a requested file that doesn't exist. The file is served
+// directly, without redirecting the client, so that the URL stays the same.
+func (s *Server) serveFallbackFile(w http.ResponseWriter, r *http.Request, logCtx *log.Entry, artifactID int64, fsys http.FileSystem, filename string) {
+	logCtx = logCtx.WithField("fallback_file", filename)
+
+	file, err := fsys.Open("/" + filename)
+	if err != nil {
+		logCtx.WithError(err).Warn("unable to open fallback file")
+		httpError(w, r, http.StatusNotFound)
+		return
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil || info.IsDir() {
+		logCtx.WithError(err).Warn("fallback file is not a regular file")
+		httpError(w, r, http.StatusNotFound)
+		return
+	}
+
+	logCtx.Info("requested file not found in artifact, serving fallback file")
+	s.writeContentTypeHeaders(w, filename)
+	writeETag(w, artifactID, filename)
+	http.ServeContent(w, r, info.Name(), info.ModTime(), file)
+}
+
+func (s *Server) getClient(t *Target) (*github.Client, error) {
 	s.m.Lock()
 	defer s.m.Unlock()
 
@@ -305,63 +802,523 @@ func (s *Server) getClient(t *Target) *github.Client {
 	if !ok {
 		var client *http.Client
 		if t.Token != nil {
-			client = oauth2.NewClient(context.Background(), oauth2.StaticTokenSource(
-				&oauth2.Token{AccessToken: s.Config.Tokens[*t.Token]},
-			))
+			token := s.Config.Tokens[*t.Token]
+			rlTransport := &rateLimitTransport{tokenID: *t.Token}
+			if token.App != nil {
+				transport, err := token.App.newTransport(rlTransport, t.BaseURL)
+				if err != nil {
+					return nil, err
+				}
+				client = &http.Client{Transport: transport}
+			} else {
+				client = &http.Client{
+					Transport: &tokenRefreshTransport{
+						server:  s,
+						tokenID: *t.Token,
+						base: &oauth2.Transport{
+							Source: oauth2.StaticTokenSource(&oauth2.Token{AccessToken: token.Value}),
+							Base:   rlTransport,
+						},
+						retryBase: rlTransport,
+					},
+				}
+			}
 		} else {
 			client = new(http.Client)
 		}
 
-		client.Timeout = 30 * time.Second
-
-		ghClient = github.NewClient(client)
+		var err error
+		if ghClient, err = s.newGithubClient(client, t); err != nil {
+			return nil, err
+		}
 		s.clients[t] = ghClient
 	}
 
-	return ghClient
+	return ghClient, nil
+}
+
+// getRequestClient returns the GitHub client to handle the given request for
+// the given target with. For targets that allow client tokens, a client is
+// created on the fly with the token from the Authorization header of the
+// request. If no client could be obtained, an error response is written and
+// false is returned.
+func (s *Server) getRequestClient(w http.ResponseWriter, r *http.Request, logCtx *log.Entry, target *Target) (*github.Client, bool) {
+	if !target.AllowClientToken {
+		client, err := s.getClient(target)
+		if err != nil {
+			logCtx.WithError(err).Error("unable to create github client")
+			httpError(w, r, http.StatusInternalServerError)
+			return nil, false
+		}
+		return client, true
+	}
+
+	token, ok := getClientToken(r)
+	if !ok {
+		logCtx.Warn("missing github token for target")
+		w.Header().Set("WWW-Authenticate", `Bearer realm="github-artifact-proxy"`)
+		httpError(w, r, http.StatusUnauthorized)
+		return nil, false
+	}
+
+	client, err := s.newGithubClient(&http.Client{
+		Transport: &oauth2.Transport{
+			Source: oauth2.StaticTokenSource(&oauth2.Token{AccessToken: token}),
+		},
+	}, target)
+	if err != nil {
+		logCtx.WithError(err).Error("unable to create github client")
+		httpError(w, r, http.StatusInternalServerError)
+		return nil, false
+	}
+	return client, true
+}
+
+// newGithubClient wraps the given HTTP client in a GitHub client for the API of
+// the given target.
+func (s *Server) newGithubClient(client *http.Client, t *Target) (*github.Client, error) {
+	client.Timeout = s.GithubTimeout
+
+	ghClient := github.NewClient(client)
+	if t.BaseURL != nil {
+		return ghClient.WithEnterpriseURLs(*t.BaseURL, getUploadURL(*t.BaseURL))
+	}
+	return ghClient, nil
+}
+
+// getUploadURL derives the upload URL of a GitHub Enterprise Server instance
+// from its API base URL. The proxy never uploads anything, but go-github
+// requires one to be set.
+func getUploadURL(baseURL string) string {
+	u, err := url.Parse(baseURL)
+	if err != nil {
+		return baseURL
+	}
+	return (&url.URL{Scheme: u.Scheme, Host: u.Host, Path: "/api/uploads/"}).String()
+}
+
+// ReloadConfig atomically replaces the configuration of the server. Targets
+// that still point to the same workflow keep their run cache. GitHub
+// clients are only kept for targets that still use the same token.
+func (s *Server) ReloadConfig(cfg *Config) {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	clients := make(map[*Target]*github.Client)
+	for id, target := range cfg.Targets {
+		oldTarget, ok := s.Config.Targets[id]
+		if !ok {
+			continue
+		}
+
+		// The cached runs were looked up for the old workflow and latest
+		// filter, so they're only kept if neither changed
+		if target.hasSameWorkflow(oldTarget) {
+			target.runCache = oldTarget.runCache
+		} else {
+			log.WithField("target", id).Info("workflow or latest filter of target changed, clearing its cached runs")
+		}
+
+		if client, ok := s.clients[oldTarget]; ok &&
+			target.Token != nil && oldTarget.Token != nil &&
+			equalStringPtrs(target.BaseURL, oldTarget.BaseURL) &&
+			cfg.Tokens[*target.Token].hasSameCredentials(s.Config.Tokens[*oldTarget.Token]) {
+			clients[target] = client
+		}
+	}
+
+	if !reflect.DeepEqual(cfg.Webhook, s.Config.Webhook) {
+		log.Warn("changes to the webhook path only take effect after a restart")
+	}
+
+	// The dynamic targets are cheap to create again, and may not even be
+	// allowed anymore
+	clear(s.dynamicTargets)
+
+	s.Config = cfg
+	s.clients = clients
 }
 
 func (s *Server) getTarget(name string) (*Target, bool) {
 	s.m.Lock()
 	defer s.m.Unlock()
 
+	if strings.HasPrefix(name, dynamicTargetPrefix) {
+		if target, ok := s.dynamicTargets[name]; ok {
+			return target, true
+		}
+	}
+
 	target, ok := s.Config.Targets[name]
 	return target, ok
 }
 
-func (s *Server) getArtifactCacheDir(artifactID int64) string {
-	return filepath.Join(s.DownloadDir, "artifacts", strconv.FormatInt(artifactID, 10))
+// getCacheTTL returns the duration after which cached GitHub API responses
+// for the given target are invalidated.
+func (s *Server) getCacheTTL(t *Target) time.Duration {
+	if t.CacheTTL != nil {
+		return t.cacheTTL
+	}
+	if t.token != nil && t.token.CacheTTL != nil {
+		return t.token.cacheTTL
+	}
+	return s.GithubCacheTTL
+}
+
+func (s *Server) getMaxArtifactSize(t *Target) int64 {
+	if t.MaxSize != nil {
+		return t.maxSize
+	}
+	return s.MaxArtifactSize
+}
+
+// checkArtifactSize verifies that the given artifact doesn't exceed the maximum
+// artifact size of the target. If it does, a 413 response is written and false
+// is returned.
+func (s *Server) checkArtifactSize(w http.ResponseWriter, r *http.Request, logCtx *log.Entry, target *Target, artifact *github.Artifact) bool {
+	maxSize := s.getMaxArtifactSize(target)
+	if maxSize <= 0 || artifact.GetSizeInBytes() <= maxSize {
+		return true
+	}
+
+	logCtx.WithFields(log.Fields{
+		"size":     artifact.GetSizeInBytes(),
+		"max_size": maxSize,
+	}).Warn("artifact exceeds the maximum size")
+	httpErrorDetail(w, r, http.StatusRequestEntityTooLarge, fmt.Sprintf("the artifact is %d bytes, which exceeds the maximum of %d bytes", artifact.GetSizeInBytes(), maxSize))
+	return false
+}
+
+// deleteArtifact removes the extracted artifact with the given key from disk.
+// It waits for any ongoing extraction of the artifact to finish first.
+func (s *Server) deleteArtifact(ctx context.Context, logCtx *log.Entry, artifactKey string) {
+	if s.memCache != nil {
+		s.memCache.Remove(getMemArtifactKey(artifactKey))
+		return
+	}
+
+	if err := s.artifactLocks.Lock(ctx, artifactKey); err != nil {
+		logCtx.WithError(err).WithField("artifact_key", artifactKey).Error("unable to acquire artifact lock")
+		return
+	}
+	defer s.artifactLocks.Unlock(artifactKey)
+
+	if s.cache != nil {
+		s.cache.Remove(artifactKey)
+	}
+	deleteDir(logCtx, s.getArtifactCacheDir(artifactKey))
+}
+
+func (s *Server) getArtifactCacheDir(artifactKey string) string {
+	return filepath.Join(s.DownloadDir, "artifacts", artifactKey)
 }
 
 func (s *Server) buildURLPath(part string) string {
 	return path.Join(s.BasePath, part)
 }
 
+// buildRedirectURL returns the URL to redirect the given request to the given
+// URL path with. If forwarded headers are trusted, the path prefix, scheme and
+// host that the reverse proxy in front of us passes along are taken into
+// account, so that the redirect works for the client.
+func (s *Server) buildRedirectURL(r *http.Request, urlPath string) string {
+	if !s.TrustForwarded {
+		return urlPath
+	}
+
+	if prefix := getForwardedHeader(r, "X-Forwarded-Prefix"); prefix != "" {
+		prefix = path.Clean("/" + prefix)
+		urlPath = strings.TrimSuffix(prefix, "/") + urlPath
+	}
+
+	proto := getForwardedHeader(r, "X-Forwarded-Proto")
+	host := getForwardedHeader(r, "X-Forwarded-Host")
+	if proto == "" && host == "" {
+		return urlPath
+	}
+
+	u := url.URL{Scheme: "http", Host: r.Host, Path: urlPath}
+	if r.TLS != nil {
+		u.Scheme = "https"
+	}
+	if proto == "http" || proto == "https" {
+		u.Scheme = proto
+	}
+	if host != "" && !strings.ContainsAny(host, "/\\@?# ") {
+		u.Host = host
+	}
+	return u.String()
+}
+
+// getForwardedHeader returns the value of the given X-Forwarded-* header. If a
+// chain of proxies appended multiple values, the first one is returned, as
+// that's the one closest to the client.
+func getForwardedHeader(r *http.Request, name string) string {
+	value, _, _ := strings.Cut(r.Header.Get(name), ",")
+	return strings.TrimSpace(value)
+}
+
+func (s *Server) buildHealthURLPath(part string) string {
+	if s.HealthPaths.SkipBasePath {
+		return path.Join("/", part)
+	}
+	return s.buildURLPath(part)
+}
+
 func (s *Server) getFileServer(dir string) httprouter.Handle {
-	fs := http.StripPrefix(s.BasePath, http.FileServer(http.Dir(dir)))
+	fs := http.StripPrefix(s.BasePath, http.FileServer(s.getArtifactFileSystem(http.Dir(dir))))
 	return func(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+		requestLogger(r.Context()).WithFields(log.Fields{
+			"addr": r.RemoteAddr,
+			"path": r.URL.Path,
+		}).Info("handling file request")
+
+		// Only the directories of extracted artifacts are served. The path is
+		// cleaned the same way the file server does, so that the checks below
+		// can't be bypassed with empty or dot segments. Everything else in the
+		// download directory (e.g. temporary directories) is never exposed.
+		key, filename, _ := strings.Cut(strings.TrimPrefix(path.Clean("/"+params.ByName("filename")), "/"), "/")
+		id, ok := parseArtifactKey(key)
+		if !ok {
+			httpError(w, r, http.StatusNotFound)
+			return
+		}
+
+		// Artifacts of targets with access control are always served inline
+		// through the target itself, never through the file server
+		if isArtifactProtected(s.getArtifactCacheDir(key)) {
+			httpError(w, r, http.StatusNotFound)
+			return
+		}
+
+		// Keep the artifact from being evicted until it has been served
+		s.artifactServeLocks.RLock(key)
+		defer s.artifactServeLocks.RUnlock(key)
+
+		if s.cache != nil {
+			s.cache.Touch(key)
+		}
+
+		// The cleaned filename has lost any trailing slash, so directories
+		// are recognized by looking them up instead
+		info, err := statFile(s.getArtifactCacheDir(key), filename)
+		if err == nil && !info.IsDir() {
+			writeETag(w, id, filename)
+		}
+
+		// Don't let clients cache errors for missing files
+		if s.ArtifactMaxAge > 0 && err == nil {
+			writeImmutableCacheHeaders(w, s.ArtifactMaxAge)
+		}
+
 		writeCacheHeaders(w)
+		s.writeContentTypeHeaders(w, params.ByName("filename"))
 		fs.ServeHTTP(w, r)
 	}
 }
 
+// statFile returns the info of the file or directory with the given
+// slash-separated path in the given directory.
+func statFile(dir string, name string) (fs.FileInfo, error) {
+	f, err := http.Dir(dir).Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return f.Stat()
+}
+
+// getArtifactFileSystem wraps the given file system of extracted artifacts
+// for the file server, which serves the index.html file of directories
+// instead of a listing. The file server looks for the configured index file
+// instead, and directories without one are hidden if listings are disabled,
+// so that requests for them get a 404 response.
+func (s *Server) getArtifactFileSystem(fsys http.FileSystem) http.FileSystem {
+	if !s.DisableListings && s.IndexFile == defaultIndexFile {
+		return fsys
+	}
+	return artifactFileSystem{
+		fs:              fsys,
+		indexFile:       s.IndexFile,
+		disableListings: s.DisableListings,
+	}
+}
+
+type artifactFileSystem struct {
+	fs              http.FileSystem
+	indexFile       string
+	disableListings bool
+}
+
+func (fsys artifactFileSystem) Open(name string) (http.File, error) {
+	// The file server only ever opens index.html files to serve them for a
+	// directory, as requests for them are redirected to the directory
+	if path.Base(name) == defaultIndexFile {
+		name = path.Join(path.Dir(name), fsys.indexFile)
+	}
+
+	file, err := fsys.fs.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	if !fsys.disableListings {
+		return file, nil
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	if info.IsDir() {
+		index, err := fsys.fs.Open(path.Join(name, fsys.indexFile))
+		if err != nil {
+			file.Close()
+			return nil, os.ErrNotExist
+		}
+		index.Close()
+	}
+
+	return file, nil
+}
+
 func deleteFile(logCtx *log.Entry, filename string) {
 	if err := os.Remove(filename); err != nil {
-		log.WithField("file", filename).Error("unable to delete file")
+		logCtx.WithError(err).WithField("file", filename).Error("unable to delete file")
 	}
 }
 
 func deleteDir(logCtx *log.Entry, dir string) {
+	if err := removeArtifactDir(dir); err != nil {
+		logCtx.WithError(err).WithField("dir", dir).Error("unable to delete directory")
+	}
+}
+
+func deleteTempDir(logCtx *log.Entry, dir string) {
 	if err := os.RemoveAll(dir); err != nil {
-		log.WithField("dir", dir).Error("unable to delete file")
+		logCtx.WithError(err).WithField("dir", dir).Error("unable to delete temporary directory")
+	}
+}
+
+// writeGithubError logs a failed GitHub API call and writes the matching error
+// response: 504 if the request timed out, 429 if a rate limit was hit, 404 if
+// GitHub responded with 404 and 500 otherwise.
+func writeGithubError(w http.ResponseWriter, r *http.Request, logCtx *log.Entry, ghRes *github.Response, err error, msg string) {
+	if errors.Is(err, context.DeadlineExceeded) && requestTimedOut(r) {
+		logCtx.WithError(err).Warn(msg)
+		httpError(w, r, http.StatusGatewayTimeout)
+		return
+	}
+
+	if retryAfter, ok := getRateLimitRetryAfter(err); ok {
+		logCtx.WithError(err).WithField("retry_after", retryAfter).Warn(msg)
+		w.Header().Set("Retry-After", strconv.FormatInt(int64(math.Ceil(retryAfter.Seconds())), 10))
+		httpError(w, r, http.StatusTooManyRequests)
+		return
 	}
+
+	if isNotFound(ghRes) {
+		logCtx.WithError(err).Warn(msg)
+		httpError(w, r, http.StatusNotFound)
+		return
+	}
+
+	if isClientTokenRejected(r, ghRes) {
+		logCtx.WithError(err).Warn(msg)
+		w.Header().Set("WWW-Authenticate", `Bearer realm="github-artifact-proxy"`)
+		httpError(w, r, http.StatusUnauthorized)
+		return
+	}
+
+	logCtx.WithError(err).Error(msg)
+	httpError(w, r, http.StatusInternalServerError)
+}
+
+// requestTimedOut reports whether the request was aborted because it exceeded
+// the request timeout.
+func requestTimedOut(r *http.Request) bool {
+	return errors.Is(r.Context().Err(), context.DeadlineExceeded)
+}
+
+// isNotFound reports whether GitHub responded with 404.
+func isNotFound(ghRes *github.Response) bool {
+	return ghRes != nil && ghRes.Response != nil && ghRes.StatusCode == http.StatusNotFound
 }
 
-func httpError(w http.ResponseWriter, status int) {
-	msg := fmt.Sprintf("%d %s", status, strings.ToLower(http.StatusText(status)))
-	http.Error(w, msg, status)
+// writeArtifactExpired writes a 410 Gone response for the given expired
+// artifact.
+func writeArtifactExpired(w http.ResponseWriter, r *http.Request, logCtx *log.Entry, artifact *github.Artifact) {
+	logCtx.WithField("expires_at", artifact.GetExpiresAt()).Warn("artifact has expired")
+	httpErrorDetail(w, r, http.StatusGone, "the artifact has expired")
+}
+
+// errorResponse is the body of error responses for clients that asked for
+// JSON.
+type errorResponse struct {
+	Error  string `json:"error"`
+	Status int    `json:"status"`
+}
+
+// httpError writes an error response with the given status code. The body is
+// JSON if the client asked for it, and plain text otherwise.
+func httpError(w http.ResponseWriter, r *http.Request, status int) {
+	httpErrorDetail(w, r, status, "")
+}
+
+// httpErrorDetail is like httpError, but adds the given detail to the error
+// message.
+func httpErrorDetail(w http.ResponseWriter, r *http.Request, status int, detail string) {
+	msg := strings.ToLower(http.StatusText(status))
+	if detail != "" {
+		msg += ": " + detail
+	}
+
+	if !requestsJSON(r) {
+		http.Error(w, fmt.Sprintf("%d %s", status, msg), status)
+		return
+	}
+
+	// Mirror what http.Error does for plain text responses
+	header := w.Header()
+	header.Del("Content-Length")
+	header.Set("Content-Type", "application/json")
+	header.Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(errorResponse{Error: msg, Status: status})
 }
 
 func writeCacheHeaders(w http.ResponseWriter) {
-	w.Header().Add("Cache-Control", "no-cache")
+	// Don't override a Cache-Control header that was configured for the target
+	if w.Header().Get("Cache-Control") == "" {
+		w.Header().Add("Cache-Control", "no-cache")
+	}
+}
+
+// writeImmutableCacheHeaders allows clients and shared caches to cache the
+// response for the given duration without revalidating it.
+func writeImmutableCacheHeaders(w http.ResponseWriter, maxAge time.Duration) {
+	w.Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%d, immutable", int64(maxAge.Seconds())))
+}
+
+// writeTargetHeaders sets the custom response headers of the given target.
+func writeTargetHeaders(w http.ResponseWriter, target *Target) {
+	for name, value := range target.Headers {
+		w.Header().Set(name, value)
+	}
+}
+
+// writeETag sets the ETag header for the given file of an artifact. The
+// content of an artifact never changes once it's published, so the ETag is
+// derived from the artifact ID and the path of the file. The file server takes
+// care of answering conditional requests with 304 responses. Directories are
+// skipped, because their listing may change if only some of the files of an
+// artifact were extracted.
+func writeETag(w http.ResponseWriter, artifactID int64, filename string) {
+	if filename == "" || strings.HasSuffix(filename, "/") {
+		return
+	}
+
+	h := fnv.New64a()
+	io.WriteString(h, path.Clean("/"+filename))
+	w.Header().Set("ETag", fmt.Sprintf("\"%d-%x\"", artifactID, h.Sum64()))
 }
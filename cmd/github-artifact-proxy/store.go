@@ -0,0 +1,24 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+)
+
+// errArtifactNotStored is returned by an ArtifactStore if it doesn't have the
+// ZIP file of the requested artifact.
+var errArtifactNotStored = errors.New("artifact not in store")
+
+// ArtifactStore keeps the ZIP files of downloaded artifacts in a location that
+// is shared between replicas of the proxy, so that every artifact only has to
+// be downloaded from GitHub once. Artifacts are still extracted to and served
+// from the local download directory.
+type ArtifactStore interface {
+	// Get returns the ZIP file of the artifact with the given key, or
+	// errArtifactNotStored if the store doesn't have it.
+	Get(ctx context.Context, artifactKey string) (io.ReadCloser, error)
+	// Put stores the given ZIP file of the artifact with the given key.
+	Put(ctx context.Context, artifactKey string, file *os.File) error
+}
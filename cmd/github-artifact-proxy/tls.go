@@ -0,0 +1,52 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// TLSConfig configures how the HTTP server terminates TLS. Either a
+// certificate and key file or a list of ACME hostnames can be configured.
+type TLSConfig struct {
+	CertFile string
+	KeyFile  string
+	// ACMEHosts are the hostnames to automatically obtain certificates for
+	// from Let's Encrypt.
+	ACMEHosts    []string
+	ACMEEmail    string
+	ACMECacheDir string
+}
+
+// Enabled reports whether TLS is configured.
+func (c *TLSConfig) Enabled() bool {
+	return c.CertFile != "" || c.KeyFile != "" || len(c.ACMEHosts) > 0
+}
+
+// Build returns the TLS configuration for the HTTP server. If ACME is not
+// used, the certificate and key file are expected to be passed to
+// ListenAndServeTLS instead.
+func (c *TLSConfig) Build() (*tls.Config, error) {
+	if len(c.ACMEHosts) == 0 {
+		if c.CertFile == "" || c.KeyFile == "" {
+			return nil, fmt.Errorf("both a certificate and a key file are required")
+		}
+		return nil, nil
+	}
+
+	if c.CertFile != "" || c.KeyFile != "" {
+		return nil, fmt.Errorf("a certificate and key file can't be combined with ACME")
+	}
+	if c.ACMECacheDir == "" {
+		return nil, fmt.Errorf("ACME requires a cache directory")
+	}
+
+	manager := &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		Cache:      autocert.DirCache(c.ACMECacheDir),
+		HostPolicy: autocert.HostWhitelist(c.ACMEHosts...),
+		Email:      c.ACMEEmail,
+	}
+	return manager.TLSConfig(), nil
+}
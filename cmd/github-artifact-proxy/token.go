@@ -0,0 +1,238 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"os/exec"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/bradleyfalzon/ghinstallation/v2"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	tokenRefreshTimeout = 30 * time.Second
+)
+
+type Token struct {
+	Value string `yaml:"value"`
+	// RefreshCommand is executed to obtain a fresh token value when GitHub
+	// rejects the current one. The command must print the new token to stdout.
+	RefreshCommand []string `yaml:"refresh_command"`
+	// File is the path of a file to read the token value from, like a mounted
+	// secret. It's read again whenever GitHub rejects the current token.
+	File string `yaml:"file"`
+	// App authenticates as a GitHub App installation instead. Installation
+	// tokens are minted and refreshed automatically.
+	App *GithubApp `yaml:"app"`
+	// CacheTTL overrides the -github-api-cache-ttl flag for the targets that
+	// use this token, unless they have a cache TTL of their own
+	CacheTTL *string `yaml:"cache_ttl"`
+
+	cacheTTL time.Duration
+}
+
+type GithubApp struct {
+	AppID          int64  `yaml:"app_id"`
+	InstallationID int64  `yaml:"installation_id"`
+	PrivateKeyPath string `yaml:"private_key_path"`
+
+	privateKey []byte
+}
+
+// UnmarshalYAML allows a token to be specified as a plain string, in which
+// case it's used as the token value.
+func (t *Token) UnmarshalYAML(node *yaml.Node) error {
+	if node.Kind == yaml.ScalarNode {
+		return node.Decode(&t.Value)
+	}
+
+	type rawToken Token
+	return node.Decode((*rawToken)(t))
+}
+
+// hasSameCredentials reports whether both tokens authenticate in the same way,
+// i.e. whether a GitHub client that uses one can be reused for the other.
+func (t *Token) hasSameCredentials(o *Token) bool {
+	return t.Value == o.Value && reflect.DeepEqual(t.App, o.App)
+}
+
+// load validates the GitHub App configuration and reads its private key.
+func (a *GithubApp) load() error {
+	if a.AppID == 0 || a.InstallationID == 0 || a.PrivateKeyPath == "" {
+		return fmt.Errorf("app_id, installation_id and private_key_path are required")
+	}
+
+	key, err := os.ReadFile(a.PrivateKeyPath)
+	if err != nil {
+		return fmt.Errorf("read private key: %w", err)
+	}
+
+	// Parse the key once up front to catch mistakes early
+	if _, err := ghinstallation.NewAppsTransport(http.DefaultTransport, a.AppID, key); err != nil {
+		return fmt.Errorf("parse private key: %w", err)
+	}
+
+	a.privateKey = key
+	return nil
+}
+
+// newTransport returns a transport that authenticates requests as the GitHub
+// App installation. If baseURL is not nil, installation tokens are requested
+// from that GitHub Enterprise Server instance.
+func (a *GithubApp) newTransport(base http.RoundTripper, baseURL *string) (http.RoundTripper, error) {
+	transport, err := ghinstallation.New(base, a.AppID, a.InstallationID, a.privateKey)
+	if err != nil {
+		return nil, err
+	}
+	if baseURL != nil {
+		transport.BaseURL = *baseURL
+	}
+	return transport, nil
+}
+
+// canRefresh reports whether a fresh value can be obtained for the token.
+func (t *Token) canRefresh() bool {
+	return len(t.RefreshCommand) > 0 || t.File != ""
+}
+
+// fetch obtains a fresh token value, either by executing the refresh command
+// of the token or by reading its file.
+func (t *Token) fetch(ctx context.Context) (string, error) {
+	if len(t.RefreshCommand) == 0 {
+		return t.readFile()
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, tokenRefreshTimeout)
+	defer cancel()
+
+	var stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, t.RefreshCommand[0], t.RefreshCommand[1:]...)
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("run refresh command: %w: %s", err, strings.TrimSpace(stderr.String()))
+	}
+
+	value := strings.TrimSpace(string(out))
+	if value == "" {
+		return "", fmt.Errorf("refresh command printed an empty token")
+	}
+
+	return value, nil
+}
+
+// readFile reads the token value from the file of the token.
+func (t *Token) readFile() (string, error) {
+	data, err := os.ReadFile(t.File)
+	if err != nil {
+		return "", fmt.Errorf("read token file: %w", err)
+	}
+
+	value := strings.TrimSpace(string(data))
+	if value == "" {
+		return "", fmt.Errorf("token file is empty: %s", t.File)
+	}
+
+	return value, nil
+}
+
+// refreshToken obtains a fresh value for the token with the given ID and drops
+// the GitHub clients that use it, so that they're rebuilt with the new value.
+// If the token was already refreshed by someone else since oldValue was used,
+// the current value is returned instead.
+func (s *Server) refreshToken(ctx context.Context, tokenID string, oldValue string) (string, error) {
+	s.refreshMutex.Lock()
+	defer s.refreshMutex.Unlock()
+
+	s.m.Lock()
+	token, ok := s.Config.Tokens[tokenID]
+	if !ok {
+		s.m.Unlock()
+		return "", fmt.Errorf("token with id '%s' no longer exists", tokenID)
+	}
+	value := token.Value
+	s.m.Unlock()
+
+	if value != oldValue {
+		return value, nil
+	}
+
+	value, err := token.fetch(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	token.Value = value
+	for t := range s.clients {
+		if t.Token != nil && *t.Token == tokenID {
+			delete(s.clients, t)
+		}
+	}
+
+	return value, nil
+}
+
+// tokenRefreshTransport refreshes the token and retries the request once if
+// GitHub responds with 401 Unauthorized.
+type tokenRefreshTransport struct {
+	server  *Server
+	tokenID string
+	// base adds the token to the request
+	base http.RoundTripper
+	// retryBase sends the retried request, which already includes the token
+	retryBase http.RoundTripper
+}
+
+func (t *tokenRefreshTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	res, err := t.base.RoundTrip(req)
+	if err != nil || res.StatusCode != http.StatusUnauthorized {
+		return res, err
+	}
+	if req.Body != nil && req.GetBody == nil {
+		return res, nil
+	}
+
+	t.server.m.Lock()
+	token, ok := t.server.Config.Tokens[t.tokenID]
+	if !ok {
+		// The token was removed from the config by a reload
+		t.server.m.Unlock()
+		res.Body.Close()
+		return nil, fmt.Errorf("token with id '%s' no longer exists", t.tokenID)
+	}
+	oldValue := token.Value
+	t.server.m.Unlock()
+	if !token.canRefresh() {
+		return res, nil
+	}
+
+	logCtx := requestLogger(req.Context()).WithField("token", t.tokenID)
+	logCtx.Warn("github rejected token, refreshing")
+
+	value, err := t.server.refreshToken(req.Context(), t.tokenID, oldValue)
+	if err != nil {
+		logCtx.WithError(err).Error("unable to refresh token")
+		return res, nil
+	}
+	res.Body.Close()
+
+	retryReq := req.Clone(req.Context())
+	if req.GetBody != nil {
+		if retryReq.Body, err = req.GetBody(); err != nil {
+			return nil, err
+		}
+	}
+	retryReq.Header.Set("Authorization", "Bearer "+value)
+
+	logCtx.Info("refreshed token, retrying request")
+	return t.retryBase.RoundTrip(retryReq)
+}
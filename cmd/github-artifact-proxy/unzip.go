@@ -2,54 +2,455 @@ package main
 
 import (
 	"archive/zip"
+	"bytes"
+	"errors"
 	"fmt"
 	"io"
+	"io/fs"
 	"os"
+	"path"
 	"path/filepath"
+	"slices"
 	"strings"
 )
 
-func Unzip(r *zip.ReadCloser, destDir string) error {
-	for _, f := range r.File {
-		if err := extractFile(f, destDir); err != nil {
+// ErrUnzipLimit is returned by Unzip if the ZIP file exceeds the configured
+// extraction limits.
+var ErrUnzipLimit = errors.New("zip file exceeds extraction limits")
+
+const (
+	// maxSymlinkTargetSize is the maximum length of the target of a symlink
+	// entry in a ZIP file
+	maxSymlinkTargetSize = 4096
+	// maxSymlinkHops is the maximum number of symlinks that UnzipFile follows
+	// to get to the requested file
+	maxSymlinkHops = 8
+)
+
+// UnzipLimits protects against ZIP bombs. A zero value means no limit.
+type UnzipLimits struct {
+	// MaxSize is the maximum total uncompressed size in bytes.
+	MaxSize int64
+	// MaxFiles is the maximum number of entries.
+	MaxFiles int
+}
+
+func Unzip(r *zip.ReadCloser, destDir string, limits UnzipLimits) error {
+	if limits.MaxFiles > 0 && len(r.File) > limits.MaxFiles {
+		return fmt.Errorf("%w: %d entries exceeds the maximum of %d", ErrUnzipLimit, len(r.File), limits.MaxFiles)
+	}
+
+	// If an entry occurs more than once, only the last one is extracted, like
+	// most unzip tools would end up doing
+	last := getLastZipFiles(r.File)
+	var total int64
+	var hasSymlinks bool
+	for i, f := range r.File {
+		if !f.FileInfo().IsDir() && last[path.Clean(f.Name)] != i {
+			continue
+		}
+
+		maxSize := int64(-1)
+		if limits.MaxSize > 0 {
+			maxSize = limits.MaxSize - total
+		}
+
+		n, err := extractFile(f, destDir, maxSize)
+		if err != nil {
 			return err
 		}
+		total += n
+		hasSymlinks = hasSymlinks || f.Mode()&fs.ModeSymlink != 0
 	}
 
+	// Symlinks can only be checked once they're all in place, as they may
+	// point through each other
+	if hasSymlinks {
+		return filepath.WalkDir(destDir, func(path string, d fs.DirEntry, err error) error {
+			if err != nil || d.Type()&fs.ModeSymlink == 0 {
+				return err
+			}
+			return checkExtractedSymlink(destDir, path)
+		})
+	}
 	return nil
 }
 
-func extractFile(f *zip.File, destDir string) error {
+// UnzipFile extracts only the file with the given name from the ZIP file to the
+// destination directory. If the file is a symlink, the file it points to is
+// extracted as well.
+func UnzipFile(r *zip.ReadCloser, name string, destDir string, limits UnzipLimits) (err error) {
+	var symlinks []string
+	defer func() {
+		// Don't leave unverified symlinks behind if extraction fails
+		if err != nil {
+			for _, symlink := range symlinks {
+				os.Remove(symlink)
+			}
+		}
+	}()
+
+	for i := 0; i < maxSymlinkHops; i++ {
+		f := findZipFile(r, name)
+		if f == nil {
+			return fmt.Errorf("file not found in zip: %s", name)
+		}
+
+		maxSize := int64(-1)
+		if limits.MaxSize > 0 {
+			maxSize = limits.MaxSize
+		}
+
+		dest, err := getExtractPath(destDir, f.Name)
+		if err != nil {
+			return err
+		}
+		if _, err := extractFile(f, destDir, maxSize); err != nil {
+			// Don't leave a partially extracted file behind
+			os.Remove(dest)
+			return err
+		}
+
+		if f.Mode()&fs.ModeSymlink == 0 {
+			for _, symlink := range symlinks {
+				if err := checkExtractedSymlink(destDir, symlink); err != nil {
+					return err
+				}
+			}
+			return nil
+		}
+		symlinks = append(symlinks, dest)
+
+		target, err := os.Readlink(dest)
+		if err != nil {
+			return err
+		}
+		name = path.Join(path.Dir(name), filepath.ToSlash(target))
+	}
+
+	return fmt.Errorf("too many levels of symlinks in zip: %s", name)
+}
+
+// findZipFile returns the file with the given name in the ZIP file, or nil if
+// there's no such file. Directories are never returned. If the file occurs
+// more than once, the last entry is returned, like Unzip extracts.
+func findZipFile(r *zip.ReadCloser, name string) *zip.File {
+	for i := len(r.File) - 1; i >= 0; i-- {
+		if f := r.File[i]; path.Clean(f.Name) == name && !f.FileInfo().IsDir() {
+			return f
+		}
+	}
+	return nil
+}
+
+// statZipFile is like fs.Stat, except that it doesn't fail for files that occur
+// more than once in the ZIP file.
+func statZipFile(r *zip.ReadCloser, name string) (fs.FileInfo, error) {
+	if f := findZipFile(r, name); f != nil {
+		return f.FileInfo(), nil
+	}
+	return fs.Stat(r, name)
+}
+
+// getLastZipFiles returns the index of the last entry of every file in the
+// given ZIP file, by name. Directories are skipped.
+func getLastZipFiles(files []*zip.File) map[string]int {
+	last := make(map[string]int, len(files))
+	for i, f := range files {
+		if !f.FileInfo().IsDir() {
+			last[path.Clean(f.Name)] = i
+		}
+	}
+	return last
+}
+
+// findZipCollisions returns the names of the files that occur more than once
+// in the given ZIP file, and the names of the files that only differ in case
+// from another file. The latter only collide on case-insensitive file
+// systems.
+func findZipCollisions(files []*zip.File) (duplicates []string, caseConflicts []string) {
+	names := make(map[string]string)
+	for _, f := range files {
+		if f.FileInfo().IsDir() {
+			continue
+		}
+
+		name := path.Clean(f.Name)
+		key := strings.ToLower(name)
+		other, ok := names[key]
+		switch {
+		case !ok:
+			names[key] = name
+		case other == name:
+			if !slices.Contains(duplicates, name) {
+				duplicates = append(duplicates, name)
+			}
+		default:
+			caseConflicts = append(caseConflicts, name)
+		}
+	}
+	return duplicates, caseConflicts
+}
+
+// isCaseInsensitiveDir reports whether the file system of the given directory
+// is case-insensitive, by checking if a file can be found with a different
+// case.
+func isCaseInsensitiveDir(dir string) (bool, error) {
+	file, err := os.CreateTemp(dir, "case-probe-*")
+	if err != nil {
+		return false, err
+	}
+	file.Close()
+	defer os.Remove(file.Name())
+
+	_, err = os.Stat(filepath.Join(dir, strings.ToUpper(filepath.Base(file.Name()))))
+	if err != nil && !os.IsNotExist(err) {
+		return false, err
+	}
+	return err == nil, nil
+}
+
+// UnzipToMemory extracts the given ZIP file into memory. Symlinks are skipped,
+// because they can't be represented in memory.
+func UnzipToMemory(data []byte, limits UnzipLimits) (*memArtifact, error) {
+	r, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return nil, fmt.Errorf("open zip file: %w", err)
+	}
+	if limits.MaxFiles > 0 && len(r.File) > limits.MaxFiles {
+		return nil, fmt.Errorf("%w: %d entries exceeds the maximum of %d", ErrUnzipLimit, len(r.File), limits.MaxFiles)
+	}
+
+	artifact := newMemArtifact()
+	for _, f := range r.File {
+		if f.FileInfo().IsDir() || f.Mode()&fs.ModeSymlink != 0 {
+			continue
+		}
+
+		name := path.Clean(strings.TrimPrefix(f.Name, "/"))
+		if !fs.ValidPath(name) || name == "." {
+			return nil, fmt.Errorf("invalid file name in zip: %s", f.Name)
+		}
+
+		maxSize := int64(-1)
+		if limits.MaxSize > 0 {
+			maxSize = limits.MaxSize - artifact.size
+		}
+
+		fileData, err := readZipFile(f, maxSize)
+		if err != nil {
+			return nil, err
+		}
+		artifact.add(name, fileData, f.Mode(), f.Modified)
+	}
+
+	return artifact, nil
+}
+
+// readZipFile reads the contents of the given file in a ZIP file. If maxSize is
+// not negative, reading is aborted once more than maxSize bytes have been read.
+func readZipFile(f *zip.File, maxSize int64) ([]byte, error) {
 	r, err := f.Open()
 	if err != nil {
-		return err
+		return nil, err
+	}
+	defer r.Close()
+
+	var src io.Reader = r
+	if maxSize >= 0 {
+		src = io.LimitReader(r, maxSize+1)
+	}
+
+	data, err := io.ReadAll(src)
+	if err != nil {
+		return nil, err
+	}
+	if maxSize >= 0 && int64(len(data)) > maxSize {
+		return nil, fmt.Errorf("%w: uncompressed size exceeds the maximum", ErrUnzipLimit)
+	}
+	return data, nil
+}
+
+// extractFile extracts the given file to the destination directory and returns
+// the amount of bytes written. If maxSize is not negative, extraction is
+// aborted once more than maxSize bytes have been written.
+func extractFile(f *zip.File, destDir string, maxSize int64) (int64, error) {
+	r, err := f.Open()
+	if err != nil {
+		return 0, err
 	}
 	defer r.Close()
 
-	path := filepath.Join(destDir, f.Name)
-	if !strings.HasPrefix(path, filepath.Clean(destDir)+string(os.PathSeparator)) {
-		return fmt.Errorf("attempt to write outside of destination directory: %s", path)
+	path, err := getExtractPath(destDir, f.Name)
+	if err != nil {
+		return 0, err
 	}
 
+	var n int64
 	if f.FileInfo().IsDir() {
 		if err := os.MkdirAll(path, os.ModePerm); err != nil {
-			return err
+			return 0, err
+		}
+	} else if f.Mode()&fs.ModeSymlink != 0 {
+		if n, err = extractSymlink(r, path, destDir); err != nil {
+			return n, err
 		}
 	} else {
 		if err := os.MkdirAll(filepath.Dir(path), os.ModePerm); err != nil {
-			return err
+			return 0, err
+		}
+		// Don't write through a symlink that an entry with the same name in
+		// a different case left behind on a case-insensitive file system
+		if info, err := os.Lstat(path); err == nil && info.Mode()&fs.ModeSymlink != 0 {
+			if err := os.Remove(path); err != nil {
+				return 0, err
+			}
+		}
+		if n, err = writeZipFile(r, path, f.Mode(), maxSize); err != nil {
+			return n, err
 		}
 
-		f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, f.Mode())
-		if err != nil {
-			return err
+		// Keep the modification time of the file in the ZIP file, for tools
+		// that rely on it
+		if modified := f.Modified; !modified.IsZero() {
+			if err := os.Chtimes(path, modified, modified); err != nil {
+				return n, err
+			}
 		}
-		defer f.Close()
+	}
 
-		if _, err = io.Copy(f, r); err != nil {
-			return err
+	return n, nil
+}
+
+// writeZipFile writes the contents of a ZIP entry to a new file at the given
+// path. The file is closed explicitly before returning, so that errors on close
+// (e.g. a full disk) aren't lost. If maxSize is not negative, writing is
+// aborted once more than maxSize bytes have been written.
+func writeZipFile(r io.Reader, path string, mode fs.FileMode, maxSize int64) (int64, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, mode)
+	if err != nil {
+		return 0, err
+	}
+
+	var src io.Reader = r
+	if maxSize >= 0 {
+		src = io.LimitReader(r, maxSize+1)
+	}
+
+	n, err := io.Copy(file, src)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return n, err
+	}
+	if maxSize >= 0 && n > maxSize {
+		return n, fmt.Errorf("%w: uncompressed size exceeds the maximum", ErrUnzipLimit)
+	}
+	return n, nil
+}
+
+// extractSymlink creates a symlink at the given path, with the target read from
+// the given ZIP entry. An error is returned if the target is lexically outside
+// of the destination directory. That doesn't account for other symlinks, so
+// the caller must check the extracted symlink with checkExtractedSymlink once
+// the file it points to is in place.
+func extractSymlink(r io.Reader, path string, destDir string) (int64, error) {
+	data, err := io.ReadAll(io.LimitReader(r, maxSymlinkTargetSize+1))
+	if err != nil {
+		return 0, err
+	}
+	n := int64(len(data))
+	if n > maxSymlinkTargetSize {
+		return n, fmt.Errorf("symlink target is too long: %s", path)
+	}
+
+	target := string(data)
+	if target == "" || filepath.IsAbs(target) {
+		return n, fmt.Errorf("invalid symlink target: %s -> %s", path, target)
+	}
+	// Symlinks to the destination directory itself are fine as well
+	root := filepath.Clean(destDir)
+	resolved := filepath.Join(filepath.Dir(path), target)
+	if resolved != root && !strings.HasPrefix(resolved, root+string(os.PathSeparator)) {
+		return n, fmt.Errorf("symlink points outside of destination directory: %s -> %s", path, target)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), os.ModePerm); err != nil {
+		return n, err
+	}
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return n, err
+	}
+	return n, os.Symlink(target, path)
+}
+
+// getExtractPath returns the path that the ZIP entry with the given name is
+// extracted to. An error is returned if that path is outside of the destination
+// directory, or if any of its parent directories is a symlink, which an
+// earlier entry may have created to escape the destination directory.
+func getExtractPath(destDir string, name string) (string, error) {
+	root := filepath.Clean(destDir)
+	path := filepath.Join(root, name)
+	if !strings.HasPrefix(path, root+string(os.PathSeparator)) {
+		return "", fmt.Errorf("attempt to write outside of destination directory: %s", path)
+	}
+
+	rel, err := filepath.Rel(root, filepath.Dir(path))
+	if err != nil {
+		return "", err
+	}
+	if rel == "." {
+		return path, nil
+	}
+
+	dir := root
+	for _, part := range strings.Split(rel, string(os.PathSeparator)) {
+		dir = filepath.Join(dir, part)
+		info, err := os.Lstat(dir)
+		if os.IsNotExist(err) {
+			break
+		}
+		if err != nil {
+			return "", err
+		}
+		if info.Mode()&fs.ModeSymlink != 0 {
+			return "", fmt.Errorf("attempt to write through a symlink: %s", path)
 		}
 	}
+	return path, nil
+}
 
+// checkExtractedSymlink returns an error if the given extracted symlink doesn't
+// resolve to an existing path inside of the destination directory. The target
+// of a symlink is only checked lexically when it's extracted, so a symlink
+// may still escape through other symlinks. Dangling symlinks are rejected as
+// well, because their target may only come into existence later, e.g. as
+// the directory of another artifact.
+func checkExtractedSymlink(destDir string, path string) error {
+	ok, err := isWithinDir(destDir, path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return fmt.Errorf("symlink doesn't point to a file in the destination directory: %s", path)
+		}
+		return err
+	}
+	if !ok {
+		return fmt.Errorf("symlink points outside of destination directory: %s", path)
+	}
 	return nil
 }
+
+// isWithinDir reports whether the given path is inside of the given directory
+// (or is the directory itself) once all symlinks are resolved.
+func isWithinDir(dir string, path string) (bool, error) {
+	realDir, err := filepath.EvalSymlinks(dir)
+	if err != nil {
+		return false, err
+	}
+	realPath, err := filepath.EvalSymlinks(path)
+	if err != nil {
+		return false, err
+	}
+	return realPath == realDir || strings.HasPrefix(realPath, realDir+string(os.PathSeparator)), nil
+}
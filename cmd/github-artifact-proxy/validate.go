@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/google/go-github/v60/github"
+	log "github.com/sirupsen/logrus"
+)
+
+// validateConfig loads the given config files to check them for problems. If
+// checkGithub is set, the workflow of every target (or its repository, for
+// release targets) is also looked up through the GitHub API, to catch typos
+// that would otherwise only surface as 404 responses at runtime.
+func validateConfig(paths string, checkGithub bool, githubTimeout time.Duration) error {
+	cfg, err := LoadConfig(paths)
+	if err != nil {
+		return err
+	}
+	if !checkGithub {
+		return nil
+	}
+
+	// The GitHub clients are created by the server, but nothing else of it is
+	// needed
+	s := &Server{
+		ServerConfig: &ServerConfig{
+			Config:        cfg,
+			GithubTimeout: githubTimeout,
+		},
+		clients: make(map[*Target]*github.Client),
+	}
+
+	ids := make([]string, 0, len(cfg.Targets))
+	for id := range cfg.Targets {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	var failed int
+	for _, id := range ids {
+		target := cfg.Targets[id]
+		logCtx := log.WithFields(log.Fields{
+			"target":   id,
+			"owner":    target.Owner,
+			"repo":     target.Repo,
+			"workflow": target.Filenames,
+		})
+
+		// There's no token to check these targets with
+		if target.AllowClientToken {
+			logCtx.Info("skipping the github check for target that allows client tokens")
+			continue
+		}
+
+		if err := s.checkTargetOnGithub(target); err != nil {
+			logCtx.WithError(err).Error("target failed the github check")
+			failed++
+			continue
+		}
+		logCtx.Info("target passed the github check")
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("%d of %d targets failed the github check", failed, len(ids))
+	}
+	return nil
+}
+
+// checkTargetOnGithub verifies that the workflows of the given target exist,
+// the repository if it's a release target, or the artifact it's pinned to.
+func (s *Server) checkTargetOnGithub(target *Target) error {
+	client, err := s.getClient(target)
+	if err != nil {
+		return fmt.Errorf("create github client: %w", err)
+	}
+
+	ctx := context.Background()
+	if target.isRelease() {
+		_, ghRes, err := client.Repositories.Get(ctx, target.Owner, target.Repo)
+		if err != nil && isNotFound(ghRes) {
+			return fmt.Errorf("repository not found or not accessible with the token")
+		}
+		return err
+	}
+	if target.isPinned() {
+		_, ghRes, err := client.Actions.GetArtifact(ctx, target.Owner, target.Repo, *target.ArtifactID)
+		if err != nil && isNotFound(ghRes) {
+			return fmt.Errorf("artifact %d not found or not accessible with the token", *target.ArtifactID)
+		}
+		return err
+	}
+
+	for _, filename := range target.Filenames {
+		_, ghRes, err := client.Actions.GetWorkflowByFileName(ctx, target.Owner, target.Repo, filename)
+		if err != nil {
+			if isNotFound(ghRes) {
+				return fmt.Errorf("workflow '%s' not found or not accessible with the token", filename)
+			}
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"runtime"
+	"runtime/debug"
+
+	"github.com/julienschmidt/httprouter"
+	log "github.com/sirupsen/logrus"
+)
+
+// These are set at build time through the linker, e.g.:
+// -ldflags "-X main.version=v1.0.0 -X main.commit=abc1234 -X main.buildDate=2024-01-01T00:00:00Z"
+var (
+	version   = "dev"
+	commit    = ""
+	buildDate = ""
+)
+
+type versionInfo struct {
+	Version   string `json:"version"`
+	Commit    string `json:"commit,omitempty"`
+	BuildDate string `json:"build_date,omitempty"`
+	GoVersion string `json:"go_version"`
+}
+
+// getVersionInfo returns the version information of the running binary. The
+// commit and build date fall back to the VCS information that the Go toolchain
+// embeds, if they weren't set at build time.
+func getVersionInfo() *versionInfo {
+	info := &versionInfo{
+		Version:   version,
+		Commit:    commit,
+		BuildDate: buildDate,
+		GoVersion: runtime.Version(),
+	}
+
+	if buildInfo, ok := debug.ReadBuildInfo(); ok {
+		if info.Version == "dev" && buildInfo.Main.Version != "" && buildInfo.Main.Version != "(devel)" {
+			info.Version = buildInfo.Main.Version
+		}
+		for _, setting := range buildInfo.Settings {
+			switch {
+			case setting.Key == "vcs.revision" && info.Commit == "":
+				info.Commit = setting.Value
+			case setting.Key == "vcs.time" && info.BuildDate == "":
+				info.BuildDate = setting.Value
+			}
+		}
+	}
+
+	return info
+}
+
+func (v *versionInfo) String() string {
+	s := fmt.Sprintf("github-artifact-proxy %s", v.Version)
+	if v.Commit != "" {
+		s += fmt.Sprintf(" (commit %s", v.Commit)
+		if v.BuildDate != "" {
+			s += fmt.Sprintf(", built %s", v.BuildDate)
+		}
+		s += ")"
+	}
+	return s + fmt.Sprintf(", %s", v.GoVersion)
+}
+
+func (s *Server) handleVersionRequest(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	logCtx := requestLogger(r.Context()).WithFields(log.Fields{
+		"addr": r.RemoteAddr,
+		"path": r.URL.Path,
+	})
+
+	writeJSON(w, logCtx, http.StatusOK, getVersionInfo())
+}
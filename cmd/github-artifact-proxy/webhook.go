@@ -0,0 +1,161 @@
+package main
+
+import (
+	"context"
+	"mime"
+	"net/http"
+	"path"
+	"slices"
+	"strings"
+
+	"github.com/google/go-github/v60/github"
+	"github.com/julienschmidt/httprouter"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	maxWebhookPayloadSize = 25 * 1024 * 1024
+)
+
+func (s *Server) handleWebhook(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	logCtx := requestLogger(r.Context()).WithFields(log.Fields{
+		"addr":     r.RemoteAddr,
+		"path":     r.URL.Path,
+		"event":    github.WebHookType(r),
+		"delivery": github.DeliveryID(r),
+	})
+	logCtx.Info("handling webhook")
+
+	webhook := s.getWebhook()
+	if webhook == nil {
+		logCtx.Warn("webhook not configured")
+		httpError(w, r, http.StatusNotFound)
+		return
+	}
+
+	// Requests with a signature are always verified with the secret. The
+	// bearer token is only an alternative for senders that can't sign their
+	// requests.
+	var secret []byte
+	signature := r.Header.Get(github.SHA256SignatureHeader)
+	switch {
+	case signature != "" && webhook.Secret != "":
+		secret = []byte(webhook.Secret)
+	case webhook.BearerToken != "" && r.Header.Get("Authorization") != "":
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || !secureCompare(token, webhook.BearerToken) {
+			logCtx.Warn("invalid webhook bearer token")
+			httpError(w, r, http.StatusUnauthorized)
+			return
+		}
+		signature = ""
+	default:
+		logCtx.Warn("webhook signature missing")
+		httpError(w, r, http.StatusUnauthorized)
+		return
+	}
+
+	contentType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil {
+		logCtx.WithError(err).Warn("unable to parse webhook content type")
+		httpError(w, r, http.StatusBadRequest)
+		return
+	}
+
+	body := http.MaxBytesReader(w, r.Body, maxWebhookPayloadSize)
+	payload, err := github.ValidatePayloadFromBody(contentType, body, signature, secret)
+	if err != nil {
+		logCtx.WithError(err).Warn("unable to validate webhook payload")
+		httpError(w, r, http.StatusUnauthorized)
+		return
+	}
+
+	event, err := github.ParseWebHook(github.WebHookType(r), payload)
+	if err != nil {
+		logCtx.WithError(err).Warn("unable to parse webhook payload")
+		httpError(w, r, http.StatusBadRequest)
+		return
+	}
+
+	switch event := event.(type) {
+	case *github.WorkflowRunEvent:
+		if event.GetAction() != "completed" {
+			logCtx.WithField("action", event.GetAction()).Info("ignoring workflow run event")
+			break
+		}
+
+		for id, target := range s.getTargetsForEvent(event) {
+			logCtx := logCtx.WithField("target", id)
+			s.invalidateRun(r.Context(), logCtx, target, event.GetWorkflowRun().GetID())
+
+			// There's no token to download the artifacts of these targets with
+			if webhook.Prefetch && !target.AllowClientToken {
+				logCtx.Info("prefetching the latest artifacts of target")
+				go s.prefetchTarget(context.Background(), logCtx, id, target)
+			}
+		}
+	default:
+		logCtx.Info("ignoring webhook event")
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) getWebhook() *Webhook {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	return s.Config.Webhook
+}
+
+// getTargetsForEvent returns all targets that track the workflow of the given
+// workflow run event.
+func (s *Server) getTargetsForEvent(event *github.WorkflowRunEvent) map[string]*Target {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	targets := make(map[string]*Target)
+	for _, candidates := range []map[string]*Target{s.Config.Targets, s.dynamicTargets} {
+		for id, target := range candidates {
+			if target.tracksEvent(event) {
+				targets[id] = target
+			}
+		}
+	}
+
+	return targets
+}
+
+// tracksEvent reports whether the target tracks the workflow of the given
+// workflow run event.
+func (t *Target) tracksEvent(event *github.WorkflowRunEvent) bool {
+	return strings.EqualFold(t.Owner, event.GetRepo().GetOwner().GetLogin()) &&
+		strings.EqualFold(t.Repo, event.GetRepo().GetName()) &&
+		slices.Contains(t.Filenames, path.Base(event.GetWorkflow().GetPath()))
+}
+
+// invalidateRun clears the cached "latest" run of the given target, as well as
+// any cached entries for the given workflow run ID and the cached listings of
+// runs. The extracted artifacts of the given workflow run are deleted from
+// disk, because a re-run may have replaced them.
+func (s *Server) invalidateRun(ctx context.Context, logCtx *log.Entry, target *Target, runID int64) {
+	target.runCache.ClearLists()
+	invalidated := target.runCache.DeleteFunc(func(runName string, run *Run) bool {
+		return runName == "latest" || run.ID == runID
+	})
+
+	for runName, run := range invalidated {
+		if run.ID == runID {
+			for _, af := range run.Artifacts {
+				if af.ID != nil {
+					s.deleteArtifact(ctx, logCtx, target.getArtifactKey(*af.ID))
+				}
+			}
+		}
+
+		logCtx.WithFields(log.Fields{
+			"run":    runName,
+			"run_id": run.ID,
+		}).Info("invalidated cached run")
+	}
+}
@@ -11,9 +11,11 @@
             name = "github-artifact-proxy";
             src = ./.;
 
-            vendorHash = "sha256-4FvWw/WxFgOeCnA4th7rp09J+xs2xNh3d0MuplJOBW0=";
+            vendorHash = "sha256-3Y2WiK4+gRBkfFCF9vWFz7PYsf6EL9FcIzHghYuAWqA=";
 
             subPackages = [ "cmd/github-artifact-proxy" ];
+
+            ldflags = [ "-X main.commit=${self.shortRev or "dirty"}" ];
           };
         };
         pkgs = import nixpkgs {